@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/blob"
 	"github.com/acsermely/veracy.server/src/config"
 	"github.com/acsermely/veracy.server/src/db"
 	"github.com/acsermely/veracy.server/src/distributed"
 	"github.com/acsermely/veracy.server/src/handlers"
+	"github.com/acsermely/veracy.server/src/orphans"
+	"github.com/acsermely/veracy.server/src/signing"
 	"github.com/joho/godotenv"
 )
 
@@ -20,11 +25,57 @@ func main() {
 		log.Fatalf("Error loading .env file: %s", err)
 	}
 
-	db, err := db.Create()
+	database, err := db.Create()
 	if err != nil {
 		log.Fatal("Failed to init DB")
 	}
-	defer db.Close()
+	defer database.Close()
+	go db.SweepExpired(db.SWEEP_INTERVAL)
+
+	blobs, err := initBlobStore(&conf)
+	if err != nil {
+		log.Fatalf("Failed to init blob store: %s", err)
+	}
+	err = db.InitBlobs(blobs)
+	if err != nil {
+		log.Fatalf("Failed to migrate images: %s", err)
+	}
+
+	err = db.EnsureAdmin(db.DEFAULT_ADMIN_NAME, os.Getenv("ADMIN_KEY"))
+	if err != nil {
+		log.Fatalf("Failed to init admin: %s", err)
+	}
+
+	err = signing.Init()
+	if err != nil {
+		log.Fatalf("Failed to init signing keys: %s", err)
+	}
+
+	handlers.Uploads = handlers.UploadLimits{
+		MaxRequestSize: conf.MaxUploadSize,
+		Quota: db.ImageQuota{
+			Bytes:  conf.QuotaBytes,
+			Images: conf.QuotaImages,
+		},
+		MaxSessionSize: conf.MaxUploadSessionSize,
+		SessionDir:     conf.UploadSessionDir,
+	}
+
+	arweaveClient := arweave.NewClient(arweave.Config{
+		ArweaveGateways:   conf.ArweaveGateways,
+		BundlerGateways:   conf.BundlerGateways,
+		ActivationAddress: conf.ActivationAddress,
+		Timeout:           conf.ArweaveTimeout,
+		Retries:           conf.ArweaveRetries,
+		Confirmations:     conf.Confirmations,
+		Cache:             db.TxCache{},
+	})
+	handlers.Arweave = arweaveClient
+
+	handlers.OrphanGrace = conf.OrphanGrace
+	if conf.OrphanInterval > 0 {
+		go orphans.Reconcile(arweaveClient, conf.OrphanInterval, conf.OrphanGrace)
+	}
 
 	port := fmt.Sprintf(":%d", conf.Port)
 
@@ -42,23 +93,60 @@ func main() {
 func initServer(port string) *http.Server {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/upload", handlers.WalletMiddleware(handlers.Upload))
-	mux.HandleFunc("/getInfo", handlers.WalletMiddleware(handlers.GetInfo))
-	mux.HandleFunc("/feedback", handlers.WalletMiddleware(handlers.AddFeedback))
-	mux.HandleFunc("/messages", handlers.WalletMiddleware(handlers.GetMessages))
-	mux.HandleFunc("/sendMessages", handlers.WalletMiddleware(handlers.SendMessage))
-	mux.HandleFunc("/savedMessages", handlers.WalletMiddleware(handlers.MessageSaved))
+	mux.HandleFunc("/upload", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.Upload))
+	mux.HandleFunc("/createUpload", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.CreateUpload))
+	mux.HandleFunc("/uploadOffset", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.GetUploadOffset))
+	mux.HandleFunc("/uploadChunk", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.UploadChunk))
+	mux.HandleFunc("/finishUpload", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.FinishUpload))
+	mux.HandleFunc("/cancelUpload", handlers.ScopedWalletMiddleware(db.API_SCOPE_UPLOAD, handlers.CancelUpload))
+	mux.HandleFunc("/setTeaser", handlers.ScopedWalletMiddleware(db.API_SCOPE_MANAGE, handlers.SetTeaser))
+	mux.HandleFunc("/deleteChallange", handlers.ScopedWalletMiddleware(db.API_SCOPE_MANAGE, handlers.GetDeleteChal))
+	mux.HandleFunc("/deleteImage", handlers.ScopedWalletMiddleware(db.API_SCOPE_MANAGE, handlers.DeleteImage))
+	mux.HandleFunc("/getInfo", handlers.ScopedWalletMiddleware(db.API_SCOPE_INFO, handlers.GetInfo))
+	mux.HandleFunc("/me/images", handlers.ScopedWalletMiddleware(db.API_SCOPE_INFO, handlers.MyImages))
+	mux.HandleFunc("/me/posts", handlers.ScopedWalletMiddleware(db.API_SCOPE_INFO, handlers.MyPosts))
+	mux.HandleFunc("/me/purchases", handlers.ScopedWalletMiddleware(db.API_SCOPE_INFO, handlers.MyPurchases))
+	mux.HandleFunc("/me/subscriptions", handlers.ScopedWalletMiddleware(db.API_SCOPE_INFO, handlers.MySubscriptions))
+	mux.HandleFunc("/feedback", handlers.ScopedWalletMiddleware(db.API_SCOPE_FEEDBACK, handlers.AddFeedback))
+	mux.HandleFunc("/messages", handlers.ScopedWalletMiddleware(db.API_SCOPE_MESSAGES_READ, handlers.GetMessages))
+	mux.HandleFunc("/sendMessages", handlers.ScopedWalletMiddleware(db.API_SCOPE_MESSAGES_WRITE, handlers.SendMessage))
+	mux.HandleFunc("/savedMessages", handlers.ScopedWalletMiddleware(db.API_SCOPE_MESSAGES_WRITE, handlers.MessageSaved))
+	mux.HandleFunc("/logout", handlers.WalletMiddleware(handlers.Logout))
+	mux.HandleFunc("/logoutAll", handlers.WalletMiddleware(handlers.LogoutAll))
+	mux.HandleFunc("/sessions", handlers.WalletMiddleware(handlers.GetSessions))
+	mux.HandleFunc("/revokeSession", handlers.WalletMiddleware(handlers.RevokeSession))
+	mux.HandleFunc("/keys", handlers.WalletMiddleware(handlers.ListKeys))
+	mux.HandleFunc("/apiKeys", handlers.WalletMiddleware(handlers.ListApiKeys))
+	mux.HandleFunc("/createApiKey", handlers.WalletMiddleware(handlers.CreateApiKey))
+	mux.HandleFunc("/revokeApiKey", handlers.WalletMiddleware(handlers.RevokeApiKey))
 
 	mux.HandleFunc("/img", handlers.Image)
-	mux.HandleFunc("/registerKey", handlers.Register)
-	mux.HandleFunc("/challange", handlers.GetLoginChal)
-	mux.HandleFunc("/loginChal", handlers.LoginWhitChal)
+	mux.HandleFunc("/registerKey", handlers.RateLimitMiddleware(registerLimit(), handlers.Register))
+	mux.HandleFunc("/challange", handlers.RateLimitMiddleware(challengeLimit(handlers.WalletFromQuery, db.CHALLENGE_PURPOSE_LOGIN), handlers.GetLoginChal))
+	mux.HandleFunc("/loginChal", handlers.RateLimitMiddleware(loginLimit(handlers.WalletFromBody, db.CHALLENGE_PURPOSE_LOGIN), handlers.LoginWhitChal))
+	mux.HandleFunc("/signChallange", handlers.RateLimitMiddleware(challengeLimit(handlers.WalletFromQuery, db.CHALLENGE_PURPOSE_LOGIN_SIGN), handlers.GetSignChal))
+	mux.HandleFunc("/loginSign", handlers.RateLimitMiddleware(loginLimit(handlers.WalletFromBody, db.CHALLENGE_PURPOSE_LOGIN_SIGN), handlers.LoginWithSignature))
+	mux.HandleFunc("/refresh", handlers.RateLimitMiddleware(loginLimit(nil, ""), handlers.RefreshToken))
+	mux.HandleFunc("/keyChallange", handlers.RateLimitMiddleware(challengeLimit(handlers.WalletFromQuery, db.CHALLENGE_PURPOSE_KEY_ROTATION), handlers.GetKeyChal))
+	mux.HandleFunc("/addKey", handlers.RateLimitMiddleware(loginLimit(handlers.WalletFromBody, db.CHALLENGE_PURPOSE_KEY_ROTATION), handlers.AddKey))
+	mux.HandleFunc("/revokeKey", handlers.RateLimitMiddleware(loginLimit(handlers.WalletFromBody, db.CHALLENGE_PURPOSE_KEY_ROTATION), handlers.RevokeKey))
+	mux.HandleFunc("/.well-known/jwks.json", handlers.JWKS)
 
-	mux.HandleFunc("/adminAllImages", handlers.AdminMiddleware(handlers.GetAllImages))
-	mux.HandleFunc("/adminSetImageActivity", handlers.AdminMiddleware(handlers.SetImageActivity))
+	mux.HandleFunc("/adminAllImages", handlers.AdminMiddleware(db.ADMIN_ROLE_MODERATOR, handlers.GetAllImages))
+	mux.HandleFunc("/adminImage", handlers.AdminMiddleware(db.ADMIN_ROLE_MODERATOR, handlers.GetImageContent))
+	mux.HandleFunc("/adminOrphans", handlers.AdminMiddleware(db.ADMIN_ROLE_MODERATOR, handlers.GetOrphanImages))
+	mux.HandleFunc("/adminTxCache", handlers.AdminMiddleware(db.ADMIN_ROLE_MODERATOR, handlers.GetTxCache))
+	mux.HandleFunc("/adminInvalidateTx", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.InvalidateTxCache))
+	mux.HandleFunc("/adminReverifyEntitlements", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.ReverifyEntitlements))
+	mux.HandleFunc("/adminSetImageActivity", handlers.AdminMiddleware(db.ADMIN_ROLE_MODERATOR, handlers.SetImageActivity))
+	mux.HandleFunc("/adminList", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.ListAdmins))
+	mux.HandleFunc("/adminAdd", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.AddAdmin))
+	mux.HandleFunc("/adminSetRole", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.SetAdminRole))
+	mux.HandleFunc("/adminRemove", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.RemoveAdmin))
+	mux.HandleFunc("/adminRotateSigningKey", handlers.AdminMiddleware(db.ADMIN_ROLE_SUPERADMIN, handlers.RotateSigningKey))
 
-	mux.HandleFunc("/adminChal", handlers.GetAdminChal)
-	mux.HandleFunc("/adminLogin", handlers.LoginAdminChal)
+	mux.HandleFunc("/adminChal", handlers.RateLimitMiddleware(challengeLimit(handlers.AdminFromQuery, db.CHALLENGE_PURPOSE_ADMIN_LOGIN), handlers.GetAdminChal))
+	mux.HandleFunc("/adminLogin", handlers.RateLimitMiddleware(loginLimit(handlers.AdminFromBody, db.CHALLENGE_PURPOSE_ADMIN_LOGIN), handlers.LoginAdminChal))
 
 	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
 	if err != nil {
@@ -76,6 +164,56 @@ func initServer(port string) *http.Server {
 	return server
 }
 
+// Issuing challenges for unknown wallets reaches out to the whole group, so
+// it is throttled harder per IP than answering them.
+func challengeLimit(wallet func(r *http.Request) string, lockoutPurpose string) handlers.RateLimit {
+	return handlers.RateLimit{
+		IPRate:         0.5,
+		IPBurst:        10,
+		WalletRate:     0.2,
+		WalletBurst:    5,
+		Wallet:         wallet,
+		LockoutPurpose: lockoutPurpose,
+	}
+}
+
+func loginLimit(wallet func(r *http.Request) string, lockoutPurpose string) handlers.RateLimit {
+	return handlers.RateLimit{
+		IPRate:         1,
+		IPBurst:        10,
+		WalletRate:     0.2,
+		WalletBurst:    5,
+		Wallet:         wallet,
+		LockoutPurpose: lockoutPurpose,
+	}
+}
+
+func registerLimit() handlers.RateLimit {
+	return handlers.RateLimit{
+		IPRate:      0.05,
+		IPBurst:     3,
+		WalletRate:  0.05,
+		WalletBurst: 2,
+		Wallet:      handlers.WalletFromBody,
+	}
+}
+
+// S3 credentials are secrets, they are read from the environment like the
+// admin key.
+func initBlobStore(conf *config.AppConfig) (blob.Store, error) {
+	if conf.S3Endpoint == "" {
+		return blob.NewFileStore(conf.BlobDir)
+	}
+	return blob.NewS3Store(blob.S3Config{
+		Endpoint:  conf.S3Endpoint,
+		Region:    conf.S3Region,
+		Bucket:    conf.S3Bucket,
+		Prefix:    conf.S3Prefix,
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+	})
+}
+
 func initDistributedConnection(conf *config.AppConfig) *distributed.ContentNode {
 	return distributed.Connect(conf)
 }
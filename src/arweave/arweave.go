@@ -1,259 +1,176 @@
 package arweave
 
 import (
-	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
-	"strconv"
+	"strings"
 
 	"github.com/acsermely/veracy.server/src/common"
+	"github.com/lestrrat-go/jwx/v2/jwk"
 )
 
-func Query(query string) ([]byte, error) {
+const POST_PAGE_SIZE = 100
 
-	jsonData := map[string]string{
-		"query": query,
-	}
-	jsonValue, err := json.Marshal(jsonData)
+// IsDataPrivate tells whether the post transaction publishes the data as
+// private. The transaction has to be signed by the wallet in the data id and
+// refer to the data id as a whole, so nobody else's post can unlock it.
+func (c *Client) IsDataPrivate(ctx context.Context, fullId string, tx string) (bool, error) {
+	wallet, _, _ := strings.Cut(fullId, ":")
+	content, err := c.getContent(ctx, tx, wallet, fullId)
 	if err != nil {
-		fmt.Println("Error marshaling JSON:", err)
-		return nil, err
-	}
-	resp, err := http.Post(common.BUNDLER_URL+"/graphql", common.TX_APP_CONTENT_TYPE, bytes.NewBuffer(jsonValue))
-	if err != nil {
-		fmt.Println("Error sending query:", err)
-		return nil, err
+		return false, err
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil, err
+	if content == nil {
+		return false, fmt.Errorf("ID not found")
 	}
-
-	return body, nil
+	return content.Privacy == common.TX_POST_PRIVACY_PRIVATE, nil
 }
 
-func QueryArweave(query string) ([]byte, error) {
-	jsonData := map[string]string{
-		"query": query,
-	}
-	jsonValue, err := json.Marshal(jsonData)
+// txOwner returns the wallet that signed the transaction, as indexed by the
+// gateways.
+func (c *Client) txOwner(ctx context.Context, txId string) (string, error) {
+	nodes, err := c.queryTransactions(ctx, fmt.Sprintf(`ids: [%s]`, graphQLString(txId)))
 	if err != nil {
-		fmt.Println("Error marshaling JSON:", err)
-		return nil, err
+		return "", err
 	}
-	resp, err := http.Post(common.ARWEAVE_URL+"/graphql", common.TX_APP_CONTENT_TYPE, bytes.NewBuffer(jsonValue))
-	if err != nil {
-		fmt.Println("Error sending query:", err)
-		return nil, err
+	if len(nodes) == 0 || nodes[0].Owner.Address == "" {
+		return "", ErrNotIndexed
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Println("Error reading response body:", err)
-		return nil, err
-	}
-
-	return body, nil
+	return nodes[0].Owner.Address, nil
 }
 
-func GetPostPrice(uploader string, postId string, sender string, tx string) (int64, error) {
-	query := fmt.Sprintf(`{
-		transactions(
-			owners: ["%s"],
-			recipients: ["%s"]
-			tags: [
-				{ name: "App-Name", values: ["%s"]},
-				{ name: "Version", values: ["%s"]},
-				{ name: "Type", values: ["%s"]},
-				{ name: "Target", values: ["%s"]}
-			]
-		)
-		{
-			edges {
-				node {
-					id
-					quantity {
-						winston
-					}
-					block {
-						timestamp
-					}
-				}
-			}
-		}
-	}`, uploader, common.ACTIVATION_ADDRESS, common.TX_APP_NAME, common.TX_APP_VERSION, common.TX_TYPE_SET_PRICE, postId)
-
-	jsonData, err := QueryArweave(query)
+// AddressFromKey derives the Arweave wallet address of a public RSA JWK:
+// the base64url encoded SHA-256 hash of the key modulus.
+func AddressFromKey(key string) (string, error) {
+	publicJWK, err := jwk.ParseKey([]byte(key))
 	if err != nil {
-		return 0, fmt.Errorf("query error: %w", err)
+		return "", err
 	}
 
-	var setPriceResults common.ArQueryResult
-	err = json.Unmarshal(jsonData, &setPriceResults)
-	if err != nil {
-		return 0, fmt.Errorf("error unmarshalling JSON: %w", err)
+	var rsaPublicKey rsa.PublicKey
+	if err := publicJWK.Raw(&rsaPublicKey); err != nil {
+		return "", err
 	}
 
-	if len(setPriceResults.Data.Transactions.Edges) == 0 {
-		return 0, fmt.Errorf("no price set for transaction")
-	}
-	fmt.Println("GotSetPriceTx")
-	// Get the payment transaction timestamp and quantity
-	paymentQuery := fmt.Sprintf(`{
-		transactions(
-			owners: ["%s"],
-			tags: [
-				{ name: "App-Name", values: ["%s"]},
-				{ name: "Version", values: ["%s"]},
-				{ name: "Type", values: ["%s"]},
-				{ name: "Target", values: ["%s"]}
-			]
-		)
-		{
-			edges {
-				node {
-					block {
-						timestamp
-					}
-					quantity {
-						winston
-					}
-				}
-			}
-		}
-	}`, sender, common.TX_APP_NAME, common.TX_APP_VERSION, common.TX_TYPE_PAYMENT, tx)
-
-	paymentData, err := QueryArweave(paymentQuery)
-	if err != nil {
-		return 0, fmt.Errorf("payment query error: %w", err)
-	}
-
-	var paymentResult common.ArQueryResult
-	err = json.Unmarshal(paymentData, &paymentResult)
-	if err != nil {
-		return 0, fmt.Errorf("error unmarshalling payment JSON: %w", err)
-	}
+	hash := sha256.Sum256(rsaPublicKey.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(hash[:]), nil
+}
 
-	if len(paymentResult.Data.Transactions.Edges) == 0 {
-		return 0, fmt.Errorf("no payment transaction found")
-	}
-	fmt.Println("GotPaymentTx")
-	paymentTimestamp := paymentResult.Data.Transactions.Edges[0].Node.Block.Timestamp
-	fmt.Println(paymentTimestamp)
-	fmt.Println("-")
-	paymentQuantity, err := strconv.ParseInt(paymentResult.Data.Transactions.Edges[0].Node.Quantity.Winston, 10, 64)
+// VerifyKeyOwner checks that the given JWK belongs to the wallet address.
+func VerifyKeyOwner(wallet string, key string) error {
+	address, err := AddressFromKey(key)
 	if err != nil {
-		return 0, fmt.Errorf("error parsing payment amount: %w", err)
+		return fmt.Errorf("cannot parse key: %w", err)
 	}
-
-	// Find the most recent price set before the payment that matches the payment amount
-	var validPrice int64 = 0
-	for _, edge := range setPriceResults.Data.Transactions.Edges {
-		fmt.Println(edge.Node.Block.Timestamp)
-		fmt.Println("---")
-		if edge.Node.Block.Timestamp <= paymentTimestamp {
-			priceAmount, err := strconv.ParseInt(edge.Node.Quantity.Winston, 10, 64)
-			if err != nil {
-				continue
-			}
-			if paymentQuantity >= priceAmount {
-				validPrice = priceAmount
-				break
-			}
-		}
-	}
-
-	if validPrice == 0 {
-		return 0, fmt.Errorf("no valid price found before payment")
+	if address != wallet {
+		return fmt.Errorf("key does not belong to wallet %s", wallet)
 	}
-
-	return validPrice, nil
+	return nil
 }
 
-func CheckPayment(sender string, tx string, uploader string, postId string) (bool, error) {
-	// Get the required price first - use wallet (content owner) as sender
-	requiredPrice, err := GetPostPrice(uploader, postId, sender, tx)
-	fmt.Println("Price:")
-	fmt.Println(requiredPrice)
-	if err != nil {
-		return false, nil
-	}
-
-	query := fmt.Sprintf(`{
-		transactions(
-			owners: ["%s"],
-			tags: [
-				{ name: "App-Name", values: ["%s"]},
-				{ name: "Version", values: ["%s"]},
-				{ name: "Type", values: ["%s"]},
-				{ name: "Target", values: ["%s"]}
-			]
-		)
-		{
-			edges {
-				node {
-					id
-					quantity {
-						winston
+// queryTransactions runs a transactions query with the filter on the
+// Arweave gateways, following the cursors through every page.
+func (c *Client) queryTransactions(ctx context.Context, filter string) ([]common.Node, error) {
+	nodes := []common.Node{}
+	after := ""
+	for {
+		query := fmt.Sprintf(`{
+			transactions(
+				%s
+				first: %d
+				%s
+			)
+			{
+				pageInfo {
+					hasNextPage
+				}
+				edges {
+					cursor
+					node {
+						id
+						recipient
+						owner {
+							address
+						}
+						quantity {
+							winston
+						}
+						block {
+							height
+							timestamp
+						}
+						tags {
+							name
+							value
+						}
 					}
 				}
 			}
-		}
-	}`, sender, common.TX_APP_NAME, common.TX_APP_VERSION, common.TX_TYPE_PAYMENT, tx)
-
-	jsonData, err := QueryArweave(query)
-	if err != nil {
-		return false, fmt.Errorf("query error: %w", err)
-	}
+		}`, filter, POST_PAGE_SIZE, after)
 
-	var result common.ArQueryResult
-	err = json.Unmarshal(jsonData, &result)
-	if err != nil {
-		return false, fmt.Errorf("error unmarshalling JSON: %w", err)
-	}
+		jsonData, err := c.QueryArweave(ctx, query)
+		if err != nil {
+			return nil, fmt.Errorf("query error: %w", err)
+		}
 
-	if len(result.Data.Transactions.Edges) == 0 {
-		return false, nil
-	}
+		var result common.ArQueryResult
+		if err := json.Unmarshal(jsonData, &result); err != nil {
+			return nil, fmt.Errorf("error unmarshalling JSON: %w", err)
+		}
 
-	// Check if payment amount matches required price
-	paidAmount, err := strconv.ParseInt(result.Data.Transactions.Edges[0].Node.Quantity.Winston, 10, 64)
-	if err != nil {
-		return false, fmt.Errorf("error parsing payment amount: %w", err)
+		edges := result.Data.Transactions.Edges
+		for _, edge := range edges {
+			nodes = append(nodes, edge.Node)
+		}
+		if !result.Data.Transactions.PageInfo.HasNextPage || len(edges) == 0 {
+			return nodes, nil
+		}
+		after = fmt.Sprintf(`after: %s`, graphQLString(edges[len(edges)-1].Cursor))
 	}
-
-	return paidAmount >= requiredPrice, nil
 }
 
-func IsDataPrivate(fullId string, tx string) (bool, error) {
-	postData, err := getTxById(tx)
+// GetPostIds returns the ids of every post transaction of the wallet, all
+// app versions included.
+func (c *Client) GetPostIds(ctx context.Context, wallet string) ([]string, error) {
+	nodes, err := c.queryTransactions(ctx, fmt.Sprintf(`
+		owners: [%s],
+		tags: [
+			{ name: "App-Name", values: [%s]},
+			{ name: "Type", values: [%s]}
+		]`, graphQLString(wallet), graphQLString(common.TX_APP_NAME), graphQLString(common.TX_TYPE_POST)))
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	for _, content := range postData.Content {
-		if content.Data == fullId {
-			isPrivate := content.Privacy == common.TX_POST_PRIVACY_PRIVATE
-			return isPrivate, nil
-		}
+
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
 	}
-	return false, fmt.Errorf("ID not found")
+	return ids, nil
 }
 
-func getTxById(txId string) (*common.Post, error) {
-	response, err := http.Get(fmt.Sprintf("%s/%s", common.BUNDLER_URL, txId))
+// GetReferencedData returns the data ids the posts of the wallet refer to in
+// their content. A post that can't be read fails the whole lookup, so callers
+// never mistake an unreadable post for a missing reference.
+func (c *Client) GetReferencedData(ctx context.Context, wallet string) (map[string]bool, error) {
+	postIds, err := c.GetPostIds(ctx, wallet)
 	if err != nil {
 		return nil, err
 	}
-	defer response.Body.Close()
 
-	var post common.Post
-	if err := json.NewDecoder(response.Body).Decode(&post); err != nil {
-		return nil, err
+	referenced := make(map[string]bool)
+	for _, postId := range postIds {
+		post, err := c.GetPost(ctx, postId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read post %s: %w", postId, err)
+		}
+		for _, content := range post.Content {
+			referenced[content.Data] = true
+		}
 	}
-	post.ID = txId
-	return &post, nil
+	return referenced, nil
 }
@@ -0,0 +1,88 @@
+package arweave
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+func ownerNode(id string, owner string) []common.Node {
+	return []common.Node{{ID: id, Owner: common.Owner{Address: owner}}}
+}
+
+func TestIsDataPrivate(t *testing.T) {
+	fullId := "wallet:post:1"
+	content := func(privacy string) []common.PostContent {
+		return []common.PostContent{{Type: "IMG", Privacy: privacy, Data: fullId}}
+	}
+	client := chainGateway{
+		nodes: map[string][]common.Node{
+			"private": ownerNode("private", "wallet"),
+			"public":  ownerNode("public", "wallet"),
+			"copied":  ownerNode("copied", "someone"),
+		},
+		data: map[string]any{
+			"private": common.Post{Content: content(common.TX_POST_PRIVACY_PRIVATE)},
+			"public":  common.Post{Content: content(common.TX_POST_PRIVACY_PUBLIC)},
+			// Someone else publishes the private image as public.
+			"copied": common.Post{Content: content(common.TX_POST_PRIVACY_PUBLIC), Uploader: "wallet", Owner: "wallet"},
+			"fresh":  common.Post{Content: content(common.TX_POST_PRIVACY_PUBLIC)},
+		},
+	}.client(t)
+	ctx := context.Background()
+
+	if private, err := client.IsDataPrivate(ctx, fullId, "private"); err != nil || !private {
+		t.Errorf("private post: %v, %v", private, err)
+	}
+	if private, err := client.IsDataPrivate(ctx, fullId, "public"); err != nil || private {
+		t.Errorf("public post: %v, %v", private, err)
+	}
+	if _, err := client.IsDataPrivate(ctx, "other:post:1", "public"); err == nil {
+		t.Error("accepted the post for the image of another wallet")
+	}
+	if _, err := client.IsDataPrivate(ctx, "wallet:other:1", "public"); err == nil {
+		t.Error("accepted the post for an image it doesn't refer to")
+	}
+	if _, err := client.IsDataPrivate(ctx, fullId, "copied"); err == nil {
+		t.Error("accepted the post of another wallet")
+	}
+	if _, err := client.IsDataPrivate(ctx, fullId, "fresh"); !errors.Is(err, ErrNotIndexed) {
+		t.Errorf("post without a known owner: %v, want not indexed", err)
+	}
+}
+
+// missingCache caches nothing and records the transactions found missing.
+type missingCache struct {
+	missing []string
+}
+
+func (*missingCache) GetPost(string) (*common.Post, bool, error) { return nil, false, nil }
+func (*missingCache) GetContent(string, string, string) (*common.PostContent, error) {
+	return nil, nil
+}
+func (*missingCache) PutPost(*common.Post) error { return nil }
+func (cache *missingCache) PutMissing(txId string, _ time.Duration) error {
+	cache.missing = append(cache.missing, txId)
+	return nil
+}
+
+func TestGetPostNotIndexed(t *testing.T) {
+	cache := &missingCache{}
+	client := chainGateway{
+		data: map[string]any{"fresh": common.Post{}},
+	}.client(t)
+	client.config.Cache = cache
+
+	if _, err := client.GetPost(context.Background(), "fresh"); !errors.Is(err, ErrNotIndexed) {
+		t.Errorf("fresh post: %v, want not indexed", err)
+	}
+	if _, err := client.GetPost(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing post: %v, want not found", err)
+	}
+	if len(cache.missing) != 1 || cache.missing[0] != "missing" {
+		t.Errorf("cached as missing %v, want the missing post only", cache.missing)
+	}
+}
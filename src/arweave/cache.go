@@ -0,0 +1,114 @@
+package arweave
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+const DEFAULT_NEGATIVE_TTL = time.Minute
+
+// PostCache keeps the posts read by the client. Transactions never change,
+// so a cached post is never read from a gateway again.
+type PostCache interface {
+	// GetPost returns the cached post, or whether the transaction was
+	// recently found missing. Both are empty if it wasn't looked up yet.
+	GetPost(txId string) (*common.Post, bool, error)
+	// GetContent returns the content of a cached post of the owner by its
+	// data id, nil if it isn't cached.
+	GetContent(txId string, owner string, dataId string) (*common.PostContent, error)
+	PutPost(post *common.Post) error
+	PutMissing(txId string, ttl time.Duration) error
+}
+
+type CacheStats struct {
+	Hits         int64   `json:"hits"`
+	NegativeHits int64   `json:"negativeHits"`
+	Misses       int64   `json:"misses"`
+	HitRate      float64 `json:"hitRate"`
+}
+
+type cacheCounters struct {
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+}
+
+// CacheStats counts the cache lookups since the start of the server.
+func (c *Client) CacheStats() CacheStats {
+	stats := CacheStats{
+		Hits:         c.counters.hits.Load(),
+		NegativeHits: c.counters.negativeHits.Load(),
+		Misses:       c.counters.misses.Load(),
+	}
+	if total := stats.Hits + stats.NegativeHits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits+stats.NegativeHits) / float64(total)
+	}
+	return stats
+}
+
+// GetPost reads the post stored in the data of a transaction, from the
+// cache if it was read before.
+func (c *Client) GetPost(ctx context.Context, txId string) (*common.Post, error) {
+	if c.config.Cache == nil {
+		return c.fetchPost(ctx, txId)
+	}
+
+	post, missing, err := c.config.Cache.GetPost(txId)
+	if err != nil {
+		fmt.Println(err)
+	} else if post != nil {
+		c.counters.hits.Add(1)
+		return post, nil
+	} else if missing {
+		c.counters.negativeHits.Add(1)
+		return nil, ErrNotFound
+	}
+	c.counters.misses.Add(1)
+
+	post, err = c.fetchPost(ctx, txId)
+	if errors.Is(err, ErrNotFound) {
+		if err := c.config.Cache.PutMissing(txId, c.config.NegativeTTL); err != nil {
+			fmt.Println(err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := c.config.Cache.PutPost(post); err != nil {
+		fmt.Println(err)
+	}
+	return post, nil
+}
+
+// getContent returns the content of the post with the data id, nil if the
+// post doesn't refer to it or wasn't signed by the owner.
+func (c *Client) getContent(ctx context.Context, txId string, owner string, dataId string) (*common.PostContent, error) {
+	if c.config.Cache != nil {
+		content, err := c.config.Cache.GetContent(txId, owner, dataId)
+		if err != nil {
+			fmt.Println(err)
+		} else if content != nil {
+			c.counters.hits.Add(1)
+			return content, nil
+		}
+	}
+
+	post, err := c.GetPost(ctx, txId)
+	if err != nil {
+		return nil, err
+	}
+	if post.Owner != owner {
+		return nil, nil
+	}
+	for _, content := range post.Content {
+		if content.Data == dataId {
+			return &content, nil
+		}
+	}
+	return nil, nil
+}
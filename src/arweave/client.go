@@ -0,0 +1,329 @@
+package arweave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+const (
+	DEFAULT_TIMEOUT           = 10 * time.Second
+	DEFAULT_RETRIES           = 2
+	DEFAULT_RETRY_BACKOFF     = 250 * time.Millisecond
+	DEFAULT_BREAKER_THRESHOLD = 5
+	DEFAULT_BREAKER_COOLDOWN  = 30 * time.Second
+	MAX_RESPONSE_SIZE         = 16 << 20
+)
+
+var (
+	ErrNoGateway = errors.New("no gateway available")
+	ErrNotFound  = errors.New("not found on any gateway")
+	// ErrNotIndexed is returned for a transaction the bundler serves but the
+	// gateways don't know the owner of yet. Unlike ErrNotFound it isn't
+	// cached, fresh posts are indexed within minutes.
+	ErrNotIndexed = errors.New("transaction not indexed yet")
+)
+
+// Config sets up a Client. The gateways of each list are tried in order,
+// zero values fall back to the defaults.
+type Config struct {
+	ArweaveGateways   []string
+	BundlerGateways   []string
+	ActivationAddress string
+
+	// Timeout bounds a single request to a gateway.
+	Timeout time.Duration
+	// Retries is how often a failed read goes through the gateways again,
+	// waiting RetryBackoff before the first retry and twice as long before
+	// every further one.
+	Retries      int
+	RetryBackoff time.Duration
+	// A gateway failing BreakerThreshold times in a row is skipped for
+	// BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Confirmations is how many blocks a payment needs, counting the block
+	// it was mined in. 0 accepts payments that weren't mined yet.
+	Confirmations int
+
+	HTTPClient *http.Client
+
+	// Cache keeps the posts read, missing transactions are remembered for
+	// NegativeTTL.
+	Cache       PostCache
+	NegativeTTL time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ArweaveGateways:   []string{common.ARWEAVE_URL},
+		BundlerGateways:   []string{common.BUNDLER_URL},
+		ActivationAddress: common.ACTIVATION_ADDRESS,
+		Timeout:           DEFAULT_TIMEOUT,
+		Retries:           DEFAULT_RETRIES,
+		RetryBackoff:      DEFAULT_RETRY_BACKOFF,
+		BreakerThreshold:  DEFAULT_BREAKER_THRESHOLD,
+		BreakerCooldown:   DEFAULT_BREAKER_COOLDOWN,
+		Confirmations:     DEFAULT_CONFIRMATIONS,
+		NegativeTTL:       DEFAULT_NEGATIVE_TTL,
+	}
+}
+
+// gateway keeps the circuit breaker state of a gateway.
+type gateway struct {
+	url string
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// available tells whether the breaker lets a request through. Once the
+// cooldown is over requests are let through again, the next failure opens
+// the breaker right away.
+func (g *gateway) available(now time.Time) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return !now.Before(g.openUntil)
+}
+
+func (g *gateway) succeeded() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.failures = 0
+	g.openUntil = time.Time{}
+}
+
+func (g *gateway) failed(threshold int, cooldown time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.failures++
+	if g.failures >= threshold {
+		g.openUntil = time.Now().Add(cooldown)
+	}
+}
+
+// Client reads transactions and GraphQL queries from Arweave and bundler
+// gateways.
+type Client struct {
+	config   Config
+	http     *http.Client
+	arweave  []*gateway
+	bundler  []*gateway
+	counters cacheCounters
+
+	networkHeight networkHeight
+}
+
+func NewClient(config Config) *Client {
+	defaults := DefaultConfig()
+	if len(config.ArweaveGateways) == 0 {
+		config.ArweaveGateways = defaults.ArweaveGateways
+	}
+	if len(config.BundlerGateways) == 0 {
+		config.BundlerGateways = defaults.BundlerGateways
+	}
+	if config.ActivationAddress == "" {
+		config.ActivationAddress = defaults.ActivationAddress
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.Confirmations < 0 {
+		config.Confirmations = 0
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = defaults.RetryBackoff
+	}
+	if config.BreakerThreshold <= 0 {
+		config.BreakerThreshold = defaults.BreakerThreshold
+	}
+	if config.BreakerCooldown <= 0 {
+		config.BreakerCooldown = defaults.BreakerCooldown
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = defaults.NegativeTTL
+	}
+
+	client := &Client{config: config, http: config.HTTPClient}
+	if client.http == nil {
+		client.http = &http.Client{}
+	}
+	for _, url := range config.ArweaveGateways {
+		client.arweave = append(client.arweave, &gateway{url: strings.TrimSuffix(url, "/")})
+	}
+	for _, url := range config.BundlerGateways {
+		client.bundler = append(client.bundler, &gateway{url: strings.TrimSuffix(url, "/")})
+	}
+	return client
+}
+
+// retryableError marks failures another attempt may not run into: network
+// errors, timeouts and overloaded or failing gateways.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+type statusError struct {
+	status int
+	url    string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("%s responded with %d", e.url, e.status)
+}
+
+func (c *Client) send(ctx context.Context, method string, url string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", common.TX_APP_CONTENT_TYPE)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, retryableError{err}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+		return nil, retryableError{statusError{response.StatusCode, url}}
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, statusError{response.StatusCode, url}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return nil, retryableError{err}
+	}
+	return data, nil
+}
+
+// read sends an idempotent request to the gateways in order until one
+// answers. Requests are only repeated for failures a retry could fix.
+func (c *Client) read(ctx context.Context, gateways []*gateway, method string, path string, body []byte) ([]byte, error) {
+	backoff := c.config.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		retry := false
+		notFound := true
+		tried := false
+		for _, gw := range gateways {
+			if !gw.available(time.Now()) {
+				continue
+			}
+			tried = true
+
+			data, err := c.send(ctx, method, gw.url+path, body)
+			if err == nil {
+				gw.succeeded()
+				return data, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			lastErr = err
+			var retryable retryableError
+			if errors.As(err, &retryable) {
+				gw.failed(c.config.BreakerThreshold, c.config.BreakerCooldown)
+				retry = true
+			}
+			var status statusError
+			if !errors.As(err, &status) || status.status != http.StatusNotFound {
+				notFound = false
+			}
+		}
+
+		if !tried {
+			return nil, ErrNoGateway
+		}
+		if notFound {
+			return nil, ErrNotFound
+		}
+		if !retry {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func graphQLBody(query string) ([]byte, error) {
+	return json.Marshal(map[string]string{
+		"query": query,
+	})
+}
+
+// QueryArweave runs a GraphQL query on the Arweave gateways.
+func (c *Client) QueryArweave(ctx context.Context, query string) ([]byte, error) {
+	body, err := graphQLBody(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.read(ctx, c.arweave, http.MethodPost, "/graphql", body)
+}
+
+// QueryBundler runs a GraphQL query on the bundler gateways.
+func (c *Client) QueryBundler(ctx context.Context, query string) ([]byte, error) {
+	body, err := graphQLBody(query)
+	if err != nil {
+		return nil, err
+	}
+	return c.read(ctx, c.bundler, http.MethodPost, "/graphql", body)
+}
+
+// fetchPost reads the post from the bundler and its owner from the chain,
+// whatever owner the post data claims is overwritten.
+func (c *Client) fetchPost(ctx context.Context, txId string) (*common.Post, error) {
+	data, err := c.read(ctx, c.bundler, http.MethodGet, "/"+txId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var post common.Post
+	if err := json.Unmarshal(data, &post); err != nil {
+		return nil, err
+	}
+	post.ID = txId
+	post.Owner, err = c.txOwner(ctx, txId)
+	if err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
@@ -0,0 +1,218 @@
+package arweave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+// testGateway answers every request with the status the handler picks for
+// the request count, counting from 1.
+type testGateway struct {
+	*httptest.Server
+	requests atomic.Int32
+}
+
+func newTestGateway(t *testing.T, status func(n int32) int) *testGateway {
+	t.Helper()
+	gw := &testGateway{}
+	gw.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := status(gw.requests.Add(1))
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func always(status int) func(int32) int {
+	return func(int32) int { return status }
+}
+
+func testClient(gateways ...*testGateway) *Client {
+	urls := []string{}
+	for _, gw := range gateways {
+		urls = append(urls, gw.URL)
+	}
+	return NewClient(Config{
+		ArweaveGateways: urls,
+		Timeout:         time.Second,
+		Retries:         2,
+		RetryBackoff:    time.Millisecond,
+	})
+}
+
+// chainGateway is a fake gateway with a chain. /info answers with the height,
+// GraphQL queries with the nodes of the first key found in the query, any
+// other path with the data of the transaction.
+type chainGateway struct {
+	height int64
+	nodes  map[string][]common.Node
+	data   map[string]any
+}
+
+func (chain chainGateway) client(t *testing.T) *Client {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/info":
+			json.NewEncoder(w).Encode(map[string]int64{"height": chain.height})
+		case "/graphql":
+			var body struct {
+				Query string `json:"query"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+
+			var result common.ArQueryResult
+			result.Data.Transactions.Edges = []common.Edge{}
+			for key, nodes := range chain.nodes {
+				if strings.Contains(body.Query, graphQLString(key)) {
+					for _, node := range nodes {
+						result.Data.Transactions.Edges = append(result.Data.Transactions.Edges, common.Edge{Node: node})
+					}
+					break
+				}
+			}
+			json.NewEncoder(w).Encode(result)
+		default:
+			data, ok := chain.data[strings.TrimPrefix(r.URL.Path, "/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(Config{
+		ArweaveGateways: []string{server.URL},
+		BundlerGateways: []string{server.URL},
+		Confirmations:   1,
+	})
+}
+
+func TestReadFailover(t *testing.T) {
+	down := newTestGateway(t, always(http.StatusBadGateway))
+	up := newTestGateway(t, always(http.StatusOK))
+	client := testClient(down, up)
+
+	data, err := client.read(context.Background(), client.arweave, http.MethodGet, "/info", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "/info" {
+		t.Errorf("read %q", data)
+	}
+	if down.requests.Load() != 1 || up.requests.Load() != 1 {
+		t.Errorf("requests %d and %d, want one each", down.requests.Load(), up.requests.Load())
+	}
+}
+
+func TestReadRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   func(int32) int
+		requests int32
+		err      error
+	}{
+		{"recovers", func(n int32) int {
+			if n < 3 {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusOK
+		}, 3, nil},
+		{"rate limited", always(http.StatusTooManyRequests), 3, nil},
+		{"bad request", always(http.StatusBadRequest), 1, nil},
+		{"not found", always(http.StatusNotFound), 1, ErrNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gw := newTestGateway(t, test.status)
+			client := testClient(gw)
+
+			_, err := client.read(context.Background(), client.arweave, http.MethodGet, "/tx", nil)
+			if got := gw.requests.Load(); got != test.requests {
+				t.Errorf("%d requests, want %d", got, test.requests)
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestReadBreaker(t *testing.T) {
+	gw := newTestGateway(t, always(http.StatusInternalServerError))
+	client := testClient(gw)
+	client.config.Retries = 0
+	client.config.BreakerThreshold = 2
+	client.config.BreakerCooldown = 50 * time.Millisecond
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.read(ctx, client.arweave, http.MethodGet, "/tx", nil); err == nil {
+			t.Fatal("read from a failing gateway")
+		}
+	}
+	if _, err := client.read(ctx, client.arweave, http.MethodGet, "/tx", nil); err != ErrNoGateway {
+		t.Errorf("error %v with an open breaker, want ErrNoGateway", err)
+	}
+	if gw.requests.Load() != 2 {
+		t.Errorf("%d requests, want 2", gw.requests.Load())
+	}
+
+	// After the cooldown a single request is let through, and its failure
+	// opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	client.read(ctx, client.arweave, http.MethodGet, "/tx", nil)
+	if _, err := client.read(ctx, client.arweave, http.MethodGet, "/tx", nil); err != ErrNoGateway {
+		t.Errorf("error %v after a failed probe, want ErrNoGateway", err)
+	}
+	if gw.requests.Load() != 3 {
+		t.Errorf("%d requests, want 3", gw.requests.Load())
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+	up := newTestGateway(t, always(http.StatusOK))
+
+	client := NewClient(Config{
+		ArweaveGateways: []string{slow.URL, up.URL},
+		Timeout:         20 * time.Millisecond,
+		RetryBackoff:    time.Millisecond,
+	})
+	start := time.Now()
+	if _, err := client.read(context.Background(), client.arweave, http.MethodGet, "/tx", nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("read took %v", elapsed)
+	}
+
+	// A caller giving up isn't retried.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	client = NewClient(Config{ArweaveGateways: []string{slow.URL}, Timeout: time.Second, Retries: 2})
+	if _, err := client.read(ctx, client.arweave, http.MethodGet, "/tx", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the deadline of the caller", err)
+	}
+}
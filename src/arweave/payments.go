@@ -0,0 +1,287 @@
+package arweave
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+const (
+	DEFAULT_CONFIRMATIONS = 1
+	// The network height is read again after HEIGHT_TTL, blocks come about
+	// every two minutes.
+	HEIGHT_TTL = 30 * time.Second
+)
+
+// PaymentReason tells why a payment check came out the way it did.
+type PaymentReason string
+
+const (
+	PAYMENT_PAID            PaymentReason = "paid"
+	PAYMENT_NO_PRICE        PaymentReason = "no-price"
+	PAYMENT_MISSING         PaymentReason = "no-payment"
+	PAYMENT_WRONG_RECIPIENT PaymentReason = "wrong-recipient"
+	PAYMENT_UNDERPAID       PaymentReason = "underpaid"
+	PAYMENT_UNCONFIRMED     PaymentReason = "unconfirmed"
+	PAYMENT_EXPIRED         PaymentReason = "expired"
+	// PAYMENT_LOGIN_REQUIRED is given to viewers without a token, nothing
+	// was checked for them.
+	PAYMENT_LOGIN_REQUIRED PaymentReason = "login-required"
+)
+
+// paymentReasonRank orders the failures by how close the payment came, the
+// closest one is reported when several payments fail.
+var paymentReasonRank = map[PaymentReason]int{
+	PAYMENT_MISSING:         0,
+	PAYMENT_NO_PRICE:        1,
+	PAYMENT_WRONG_RECIPIENT: 2,
+	PAYMENT_UNDERPAID:       3,
+	PAYMENT_UNCONFIRMED:     4,
+	PAYMENT_EXPIRED:         5,
+	PAYMENT_PAID:            6,
+}
+
+// Message describes the reason to the viewer.
+func (r PaymentReason) Message() string {
+	switch r {
+	case PAYMENT_PAID:
+		return "Paid"
+	case PAYMENT_NO_PRICE:
+		return "No price was set for the post before the payment"
+	case PAYMENT_MISSING:
+		return "Couldn't find payment"
+	case PAYMENT_WRONG_RECIPIENT:
+		return "The payment wasn't sent to the creator"
+	case PAYMENT_UNDERPAID:
+		return "The payment is less than the price"
+	case PAYMENT_UNCONFIRMED:
+		return "The payment isn't confirmed yet"
+	case PAYMENT_EXPIRED:
+		return "The subscription has expired"
+	case PAYMENT_LOGIN_REQUIRED:
+		return "Log in to view the image"
+	}
+	return string(r)
+}
+
+// Payment is the outcome of a payment check. Tx, Amount, Price and
+// Confirmations describe the payment that came closest to the price, amounts
+// are in winston.
+type Payment struct {
+	Paid          bool
+	Reason        PaymentReason
+	Tx            string
+	Amount        string
+	Price         string
+	Confirmations int64
+}
+
+// price is a set-price transaction of a post or a set-subscription-price
+// transaction of an uploader. Splits are the addresses that may be paid
+// besides the uploader, the period is how long a subscription lasts.
+type price struct {
+	amount *big.Int
+	height int64
+	splits []string
+	period time.Duration
+}
+
+type networkHeight struct {
+	mutex     sync.Mutex
+	height    int64
+	expiresAt time.Time
+}
+
+// graphQLString quotes a value for a GraphQL query.
+func graphQLString(value string) string {
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+func parseWinston(value string) (*big.Int, bool) {
+	amount, ok := new(big.Int).SetString(value, 10)
+	if !ok || amount.Sign() < 0 {
+		return nil, false
+	}
+	return amount, true
+}
+
+// height returns the current height of the network.
+func (c *Client) height(ctx context.Context) (int64, error) {
+	c.networkHeight.mutex.Lock()
+	defer c.networkHeight.mutex.Unlock()
+	if time.Now().Before(c.networkHeight.expiresAt) {
+		return c.networkHeight.height, nil
+	}
+
+	data, err := c.read(ctx, c.arweave, http.MethodGet, "/info", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get network height: %w", err)
+	}
+	var info struct {
+		Height int64 `json:"height"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return 0, fmt.Errorf("failed to parse network info: %w", err)
+	}
+
+	c.networkHeight.height = info.Height
+	c.networkHeight.expiresAt = time.Now().Add(HEIGHT_TTL)
+	return info.Height, nil
+}
+
+// getPrices returns the mined prices of the type the uploader set, the
+// latest first. Subscription prices are set without a target.
+func (c *Client) getPrices(ctx context.Context, uploader string, priceType string, target string) ([]price, error) {
+	targetFilter := ""
+	if target != "" {
+		targetFilter = fmt.Sprintf(`,
+			{ name: "Target", values: [%s]}`, graphQLString(target))
+	}
+	nodes, err := c.queryTransactions(ctx, fmt.Sprintf(`
+		owners: [%s],
+		recipients: [%s],
+		tags: [
+			{ name: "App-Name", values: [%s]},
+			{ name: "Version", values: [%s]},
+			{ name: "Type", values: [%s]}%s
+		]`,
+		graphQLString(uploader), graphQLString(c.config.ActivationAddress), graphQLString(common.TX_APP_NAME),
+		graphQLString(common.TX_APP_VERSION), graphQLString(priceType), targetFilter))
+	if err != nil {
+		return nil, fmt.Errorf("price query error: %w", err)
+	}
+
+	prices := []price{}
+	for _, node := range nodes {
+		amount, ok := parseWinston(node.Quantity.Winston)
+		if !ok || amount.Sign() == 0 || node.Block.Height == 0 {
+			continue
+		}
+		p := price{amount: amount, height: node.Block.Height, period: DEFAULT_SUBSCRIPTION_PERIOD}
+		for _, tag := range node.Tags {
+			switch tag.Name {
+			case common.TX_TAG_SPLIT:
+				if tag.Value != "" {
+					p.splits = append(p.splits, tag.Value)
+				}
+			case common.TX_TAG_PERIOD:
+				if days, err := strconv.Atoi(tag.Value); err == nil && days > 0 && days <= SUBSCRIPTION_MAX_PERIOD_DAYS {
+					p.period = time.Duration(days) * 24 * time.Hour
+				}
+			}
+		}
+		prices = append(prices, p)
+	}
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].height > prices[j].height
+	})
+	return prices, nil
+}
+
+// priceAt returns the price in effect at the height, the latest price for
+// payments not mined yet.
+func priceAt(prices []price, height int64) (price, bool) {
+	for _, p := range prices {
+		if height == 0 || p.height <= height {
+			return p, true
+		}
+	}
+	return price{}, false
+}
+
+// CheckPayment looks for a payment of the sender for the post transaction
+// that covers the price the uploader set for the post at the time. The
+// payment has to be sent to the uploader, or to an address the price
+// declared as a split, and have the configured number of confirmations.
+// Errors are only returned when the chain couldn't be read. The caller has to
+// make sure the transaction is a post of the uploader, see IsDataPrivate.
+func (c *Client) CheckPayment(ctx context.Context, sender string, tx string, uploader string, postId string) (Payment, error) {
+	prices, err := c.getPrices(ctx, uploader, common.TX_TYPE_SET_PRICE, postId)
+	if err != nil {
+		return Payment{}, err
+	}
+	if len(prices) == 0 {
+		return Payment{Reason: PAYMENT_NO_PRICE}, nil
+	}
+
+	payments, err := c.queryTransactions(ctx, fmt.Sprintf(`
+		owners: [%s],
+		tags: [
+			{ name: "App-Name", values: [%s]},
+			{ name: "Version", values: [%s]},
+			{ name: "Type", values: [%s]},
+			{ name: "Target", values: [%s]}
+		]`,
+		graphQLString(sender), graphQLString(common.TX_APP_NAME), graphQLString(common.TX_APP_VERSION),
+		graphQLString(common.TX_TYPE_PAYMENT), graphQLString(tx)))
+	if err != nil {
+		return Payment{}, fmt.Errorf("payment query error: %w", err)
+	}
+
+	var height int64
+	if c.config.Confirmations > 0 && len(payments) > 0 {
+		height, err = c.height(ctx)
+		if err != nil {
+			return Payment{}, err
+		}
+	}
+
+	best := Payment{Reason: PAYMENT_MISSING}
+	for _, node := range payments {
+		payment, _ := c.checkPaymentTx(node, prices, uploader, height)
+		if payment.Paid {
+			return payment, nil
+		}
+		if paymentReasonRank[payment.Reason] > paymentReasonRank[best.Reason] {
+			best = payment
+		}
+	}
+	return best, nil
+}
+
+// checkPaymentTx checks a payment against the price in effect when it was
+// mined, which is returned along.
+func (c *Client) checkPaymentTx(node common.Node, prices []price, uploader string, height int64) (Payment, price) {
+	payment := Payment{Tx: node.ID, Amount: node.Quantity.Winston}
+	amount, ok := parseWinston(node.Quantity.Winston)
+	if !ok {
+		payment.Reason = PAYMENT_UNDERPAID
+		return payment, price{}
+	}
+	if node.Block.Height > 0 && height >= node.Block.Height {
+		payment.Confirmations = height - node.Block.Height + 1
+	}
+
+	p, ok := priceAt(prices, node.Block.Height)
+	if !ok {
+		payment.Reason = PAYMENT_NO_PRICE
+		return payment, price{}
+	}
+	payment.Price = p.amount.String()
+
+	recipientOk := node.Recipient == uploader
+	for _, split := range p.splits {
+		recipientOk = recipientOk || node.Recipient == split
+	}
+	switch {
+	case !recipientOk:
+		payment.Reason = PAYMENT_WRONG_RECIPIENT
+	case amount.Cmp(p.amount) < 0:
+		payment.Reason = PAYMENT_UNDERPAID
+	case c.config.Confirmations > 0 && payment.Confirmations < int64(c.config.Confirmations):
+		payment.Reason = PAYMENT_UNCONFIRMED
+	default:
+		payment.Paid = true
+		payment.Reason = PAYMENT_PAID
+	}
+	return payment, p
+}
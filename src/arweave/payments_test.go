@@ -0,0 +1,128 @@
+package arweave
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+const (
+	testUploader = "uploader"
+	testSplit    = "split"
+)
+
+func paymentNode(id string, recipient string, winston string, height int64) common.Node {
+	return common.Node{
+		ID:        id,
+		Recipient: recipient,
+		Quantity:  common.Quantity{Winston: winston},
+		Block:     common.Block{Height: height},
+	}
+}
+
+func testPrice(amount int64, height int64, splits ...string) price {
+	return price{amount: big.NewInt(amount), height: height, splits: splits, period: DEFAULT_SUBSCRIPTION_PERIOD}
+}
+
+func TestCheckPaymentTx(t *testing.T) {
+	client := NewClient(Config{Confirmations: 2})
+	// The price went up from 100 to 200 at height 50.
+	prices := []price{testPrice(200, 50), testPrice(100, 10, testSplit)}
+
+	tests := []struct {
+		name          string
+		node          common.Node
+		reason        PaymentReason
+		price         string
+		confirmations int64
+	}{
+		{"paid", paymentNode("tx", testUploader, "100", 30), PAYMENT_PAID, "100", 71},
+		{"paid to a split", paymentNode("tx", testSplit, "100", 30), PAYMENT_PAID, "100", 71},
+		{"overpaid", paymentNode("tx", testUploader, "1000", 60), PAYMENT_PAID, "200", 41},
+		{"split of an older price", paymentNode("tx", testSplit, "200", 60), PAYMENT_WRONG_RECIPIENT, "200", 41},
+		{"wrong recipient", paymentNode("tx", "someone", "100", 30), PAYMENT_WRONG_RECIPIENT, "100", 71},
+		{"underpaid after the price change", paymentNode("tx", testUploader, "150", 60), PAYMENT_UNDERPAID, "200", 41},
+		{"paid before any price", paymentNode("tx", testUploader, "100", 5), PAYMENT_NO_PRICE, "", 96},
+		{"one confirmation", paymentNode("tx", testUploader, "200", 100), PAYMENT_UNCONFIRMED, "200", 1},
+		{"pending", paymentNode("tx", testUploader, "200", 0), PAYMENT_UNCONFIRMED, "200", 0},
+		{"invalid amount", paymentNode("tx", testUploader, "-5", 30), PAYMENT_UNDERPAID, "", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payment, _ := client.checkPaymentTx(test.node, prices, testUploader, 100)
+			if payment.Reason != test.reason || payment.Paid != (test.reason == PAYMENT_PAID) {
+				t.Errorf("reason %s paid %v, want %s", payment.Reason, payment.Paid, test.reason)
+			}
+			if payment.Price != test.price {
+				t.Errorf("price %q, want %q", payment.Price, test.price)
+			}
+			if payment.Confirmations != test.confirmations {
+				t.Errorf("%d confirmations, want %d", payment.Confirmations, test.confirmations)
+			}
+		})
+	}
+}
+
+func TestCheckPaymentTxWithoutConfirmations(t *testing.T) {
+	client := NewClient(Config{})
+	payment, _ := client.checkPaymentTx(paymentNode("tx", testUploader, "100", 0), []price{testPrice(100, 10)}, testUploader, 0)
+	if !payment.Paid {
+		t.Errorf("pending payment refused with %s", payment.Reason)
+	}
+}
+
+func TestCheckPayment(t *testing.T) {
+	client := chainGateway{height: 100, nodes: map[string][]common.Node{
+		common.TX_TYPE_SET_PRICE: {
+			paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10),
+			// Prices that aren't mined yet don't count.
+			paymentNode("pending price", common.ACTIVATION_ADDRESS, "1", 0),
+		},
+		common.TX_TYPE_PAYMENT: {
+			paymentNode("small", testUploader, "50", 20),
+			paymentNode("enough", testUploader, "100", 30),
+		},
+	}}.client(t)
+
+	payment, err := client.CheckPayment(context.Background(), "buyer", "post tx", testUploader, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !payment.Paid || payment.Tx != "enough" {
+		t.Errorf("payment %+v, want the second transaction", payment)
+	}
+}
+
+func TestCheckPaymentReportsClosest(t *testing.T) {
+	client := chainGateway{height: 100, nodes: map[string][]common.Node{
+		common.TX_TYPE_SET_PRICE: {paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+		common.TX_TYPE_PAYMENT: {
+			paymentNode("elsewhere", "someone", "100", 20),
+			paymentNode("small", testUploader, "50", 30),
+		},
+	}}.client(t)
+
+	payment, err := client.CheckPayment(context.Background(), "buyer", "post tx", testUploader, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Paid || payment.Reason != PAYMENT_UNDERPAID || payment.Tx != "small" {
+		t.Errorf("payment %+v, want the underpaid transaction", payment)
+	}
+}
+
+func TestCheckPaymentWithoutPrice(t *testing.T) {
+	client := chainGateway{height: 100, nodes: map[string][]common.Node{
+		common.TX_TYPE_PAYMENT: {paymentNode("tx", testUploader, "100", 30)},
+	}}.client(t)
+
+	payment, err := client.CheckPayment(context.Background(), "buyer", "post tx", testUploader, "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payment.Paid || payment.Reason != PAYMENT_NO_PRICE {
+		t.Errorf("payment %+v, want no price", payment)
+	}
+}
@@ -0,0 +1,173 @@
+package arweave
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+const (
+	DEFAULT_SUBSCRIPTION_PERIOD  = 30 * 24 * time.Hour
+	SUBSCRIPTION_MAX_PERIOD_DAYS = 366
+	// A single subscription transaction buys at most this many periods.
+	SUBSCRIPTION_MAX_PERIODS = 120
+)
+
+// Subscription is the outcome of a subscription check. A subscriber is
+// given access to every private post of the uploader until ExpiresAt (Unix
+// seconds), Tx is the latest transaction counted.
+type Subscription struct {
+	Uploader  string
+	Active    bool
+	Reason    PaymentReason
+	Tx        string
+	ExpiresAt int64
+}
+
+func tagValue(node common.Node, name string) string {
+	for _, tag := range node.Tags {
+		if tag.Name == name {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+func (c *Client) querySubscriptions(ctx context.Context, subscriber string, uploader string) ([]common.Node, error) {
+	targetFilter := ""
+	if uploader != "" {
+		targetFilter = fmt.Sprintf(`,
+			{ name: "Target", values: [%s]}`, graphQLString(uploader))
+	}
+	nodes, err := c.queryTransactions(ctx, fmt.Sprintf(`
+		owners: [%s],
+		tags: [
+			{ name: "App-Name", values: [%s]},
+			{ name: "Version", values: [%s]},
+			{ name: "Type", values: [%s]}%s
+		]`,
+		graphQLString(subscriber), graphQLString(common.TX_APP_NAME), graphQLString(common.TX_APP_VERSION),
+		graphQLString(common.TX_TYPE_SUBSCRIPTION), targetFilter))
+	if err != nil {
+		return nil, fmt.Errorf("subscription query error: %w", err)
+	}
+	return nodes, nil
+}
+
+// GetSubscription checks the subscription of the subscriber to the uploader.
+// Subscription transactions target the uploader and buy as many periods of
+// the subscription price in effect as they cover. A renewal paid before the
+// subscription expired extends it.
+func (c *Client) GetSubscription(ctx context.Context, subscriber string, uploader string) (Subscription, error) {
+	nodes, err := c.querySubscriptions(ctx, subscriber, uploader)
+	if err != nil {
+		return Subscription{}, err
+	}
+	return c.checkSubscription(ctx, uploader, nodes)
+}
+
+// GetSubscriptions checks every subscription of the subscriber, the active
+// and the expired ones.
+func (c *Client) GetSubscriptions(ctx context.Context, subscriber string) ([]Subscription, error) {
+	nodes, err := c.querySubscriptions(ctx, subscriber, "")
+	if err != nil {
+		return nil, err
+	}
+
+	byUploader := map[string][]common.Node{}
+	uploaders := []string{}
+	for _, node := range nodes {
+		uploader := tagValue(node, "Target")
+		if uploader == "" {
+			continue
+		}
+		if _, exists := byUploader[uploader]; !exists {
+			uploaders = append(uploaders, uploader)
+		}
+		byUploader[uploader] = append(byUploader[uploader], node)
+	}
+
+	subscriptions := []Subscription{}
+	for _, uploader := range uploaders {
+		subscription, err := c.checkSubscription(ctx, uploader, byUploader[uploader])
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func (c *Client) checkSubscription(ctx context.Context, uploader string, nodes []common.Node) (Subscription, error) {
+	subscription := Subscription{Uploader: uploader, Reason: PAYMENT_MISSING}
+	if len(nodes) == 0 {
+		return subscription, nil
+	}
+
+	prices, err := c.getPrices(ctx, uploader, common.TX_TYPE_SET_SUB_PRICE, "")
+	if err != nil {
+		return Subscription{}, err
+	}
+	if len(prices) == 0 {
+		subscription.Reason = PAYMENT_NO_PRICE
+		return subscription, nil
+	}
+
+	var height int64
+	if c.config.Confirmations > 0 {
+		height, err = c.height(ctx)
+		if err != nil {
+			return Subscription{}, err
+		}
+	}
+
+	// Periods are added up in the order they were paid, pending
+	// transactions last.
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i].Block.Height, nodes[j].Block.Height
+		return a != 0 && (b == 0 || a < b)
+	})
+
+	now := time.Now()
+	var expiresAt time.Time
+	for _, node := range nodes {
+		payment, p := c.checkPaymentTx(node, prices, uploader, height)
+		if !payment.Paid {
+			if paymentReasonRank[payment.Reason] > paymentReasonRank[subscription.Reason] {
+				subscription.Reason = payment.Reason
+			}
+			continue
+		}
+
+		amount, _ := parseWinston(node.Quantity.Winston)
+		periods := new(big.Int).Quo(amount, p.amount)
+		if periods.Cmp(big.NewInt(SUBSCRIPTION_MAX_PERIODS)) > 0 {
+			periods.SetInt64(SUBSCRIPTION_MAX_PERIODS)
+		}
+
+		start := now
+		if node.Block.Timestamp > 0 {
+			start = time.Unix(node.Block.Timestamp, 0)
+		}
+		if expiresAt.After(start) {
+			start = expiresAt
+		}
+		expiresAt = start.Add(time.Duration(periods.Int64()) * p.period)
+		subscription.Tx = node.ID
+	}
+
+	if expiresAt.IsZero() {
+		return subscription, nil
+	}
+	subscription.ExpiresAt = expiresAt.Unix()
+	subscription.Active = expiresAt.After(now)
+	subscription.Reason = PAYMENT_EXPIRED
+	if subscription.Active {
+		subscription.Reason = PAYMENT_PAID
+	}
+	return subscription, nil
+}
@@ -0,0 +1,145 @@
+package arweave
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+func subscriptionNode(id string, winston string, height int64, paidAt time.Time) common.Node {
+	node := paymentNode(id, testUploader, winston, height)
+	node.Block.Timestamp = paidAt.Unix()
+	node.Tags = []common.Tag{{Name: "Target", Value: testUploader}}
+	return node
+}
+
+func subscriptionClient(t *testing.T, prices ...common.Node) *Client {
+	return chainGateway{height: 100, nodes: map[string][]common.Node{common.TX_TYPE_SET_SUB_PRICE: prices}}.client(t)
+}
+
+func TestCheckSubscription(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.Now()
+	weekly := paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)
+	weekly.Tags = []common.Tag{{Name: common.TX_TAG_PERIOD, Value: "7"}}
+
+	tests := []struct {
+		name    string
+		prices  []common.Node
+		nodes   []common.Node
+		reason  PaymentReason
+		tx      string
+		expires time.Time
+	}{
+		{
+			name:   "no payment",
+			prices: []common.Node{paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+			reason: PAYMENT_MISSING,
+		},
+		{
+			name:   "no price",
+			nodes:  []common.Node{subscriptionNode("sub", "100", 20, now)},
+			reason: PAYMENT_NO_PRICE,
+		},
+		{
+			name:    "one period",
+			prices:  []common.Node{paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+			nodes:   []common.Node{subscriptionNode("sub", "100", 20, now.Add(-10*day))},
+			reason:  PAYMENT_PAID,
+			tx:      "sub",
+			expires: now.Add(20 * day),
+		},
+		{
+			name:   "renewed before it expired",
+			prices: []common.Node{paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+			// Listed out of order, the renewal counts from the end of the
+			// first subscription.
+			nodes: []common.Node{
+				subscriptionNode("renewal", "250", 30, now.Add(-5*day)),
+				subscriptionNode("first", "100", 20, now.Add(-10*day)),
+			},
+			reason:  PAYMENT_PAID,
+			tx:      "renewal",
+			expires: now.Add(80 * day),
+		},
+		{
+			name:    "expired",
+			prices:  []common.Node{paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+			nodes:   []common.Node{subscriptionNode("sub", "100", 20, now.Add(-40*day))},
+			reason:  PAYMENT_EXPIRED,
+			tx:      "sub",
+			expires: now.Add(-10 * day),
+		},
+		{
+			name:    "period of the price",
+			prices:  []common.Node{weekly},
+			nodes:   []common.Node{subscriptionNode("sub", "200", 20, now.Add(-day))},
+			reason:  PAYMENT_PAID,
+			tx:      "sub",
+			expires: now.Add(13 * day),
+		},
+		{
+			name:    "periods are capped",
+			prices:  []common.Node{weekly},
+			nodes:   []common.Node{subscriptionNode("sub", "1000000", 20, now)},
+			reason:  PAYMENT_PAID,
+			tx:      "sub",
+			expires: now.Add(SUBSCRIPTION_MAX_PERIODS * 7 * day),
+		},
+		{
+			name:   "underpaid",
+			prices: []common.Node{paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+			nodes:  []common.Node{subscriptionNode("sub", "99", 20, now)},
+			reason: PAYMENT_UNDERPAID,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := subscriptionClient(t, test.prices...)
+			subscription, err := client.checkSubscription(context.Background(), testUploader, test.nodes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subscription.Reason != test.reason || subscription.Active != (test.reason == PAYMENT_PAID) {
+				t.Errorf("reason %s active %v, want %s", subscription.Reason, subscription.Active, test.reason)
+			}
+			if subscription.Tx != test.tx {
+				t.Errorf("tx %q, want %q", subscription.Tx, test.tx)
+			}
+			if !test.expires.IsZero() && subscription.ExpiresAt != test.expires.Unix() {
+				t.Errorf("expires %v, want %v", time.Unix(subscription.ExpiresAt, 0), test.expires)
+			}
+		})
+	}
+}
+
+func TestGetSubscriptions(t *testing.T) {
+	now := time.Now()
+	other := subscriptionNode("other", "100", 20, now)
+	other.Tags = []common.Tag{{Name: "Target", Value: "other uploader"}}
+	untargeted := subscriptionNode("untargeted", "100", 20, now)
+	untargeted.Tags = nil
+
+	client := chainGateway{height: 100, nodes: map[string][]common.Node{
+		common.TX_TYPE_SET_SUB_PRICE: {paymentNode("price", common.ACTIVATION_ADDRESS, "100", 10)},
+		common.TX_TYPE_SUBSCRIPTION:  {subscriptionNode("sub", "100", 20, now), other, untargeted},
+	}}.client(t)
+
+	subscriptions, err := client.GetSubscriptions(context.Background(), "subscriber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 2 {
+		t.Fatalf("%d subscriptions, want 2", len(subscriptions))
+	}
+	if subscriptions[0].Uploader != testUploader || !subscriptions[0].Active {
+		t.Errorf("subscription %+v, want an active one to the uploader", subscriptions[0])
+	}
+	// The fake chain answers with the same price for every uploader, but
+	// the subscription to the other uploader was paid to the wrong one.
+	if subscriptions[1].Uploader != "other uploader" || subscriptions[1].Reason != PAYMENT_WRONG_RECIPIENT {
+		t.Errorf("subscription %+v, want the wrong recipient", subscriptions[1])
+	}
+}
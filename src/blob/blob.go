@@ -0,0 +1,52 @@
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps blobs addressed by the hex encoded SHA-256 of their content.
+// Putting content that is already stored is a no-op, so identical uploads
+// share a single blob.
+type Store interface {
+	Put(ctx context.Context, hash string, r io.Reader, size int64) error
+	Get(ctx context.Context, hash string) (io.ReadCloser, error)
+	Delete(ctx context.Context, hash string) error
+	Stat(ctx context.Context, hash string) (Info, error)
+}
+
+type Info struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) error {
+	if len(hash) != sha256.Size*2 {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return nil
+}
+
+// ReadAll reads a whole blob, images are small enough to be held in memory.
+func ReadAll(ctx context.Context, store Store, hash string) ([]byte, error) {
+	r, err := store.Get(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
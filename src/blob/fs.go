@@ -0,0 +1,108 @@
+package blob
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps blobs in a directory tree fanned out by the first bytes of
+// the hash.
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) (*FileStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &FileStore{root: root}, nil
+}
+
+func (s *FileStore) path(hash string) string {
+	return filepath.Join(s.root, hash[:2], hash[2:4], hash)
+}
+
+// Put writes to a temporary file first and only renames it into place once
+// the content matches the hash.
+func (s *FileStore) Put(ctx context.Context, hash string, r io.Reader, size int64) error {
+	if err := validHash(hash); err != nil {
+		return err
+	}
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("blob size mismatch: expected %d, got %d", size, written)
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != hash {
+		return fmt.Errorf("blob hash mismatch")
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Get(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := validHash(hash); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(s.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return file, nil
+}
+
+func (s *FileStore) Delete(ctx context.Context, hash string) error {
+	if err := validHash(hash); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) Stat(ctx context.Context, hash string) (Info, error) {
+	if err := validHash(hash); err != nil {
+		return Info{}, err
+	}
+	info, err := os.Stat(s.path(hash))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, fmt.Errorf("failed to stat blob: %w", err)
+	}
+	return Info{Hash: hash, Size: info.Size()}, nil
+}
@@ -0,0 +1,202 @@
+package blob
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3DateFormat       = "20060102T150405Z"
+	s3ErrorBodyLimit   = 512
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the service, e.g. http://localhost:9000.
+	// Buckets are addressed path style so any S3-compatible server works.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3Store keeps blobs in an S3-compatible bucket. Requests are signed with
+// AWS Signature Version 4; uploads are signed with the blob hash as payload
+// hash, so the server rejects content that doesn't match it.
+type S3Store struct {
+	config S3Config
+	client *http.Client
+}
+
+func NewS3Store(config S3Config) (*S3Store, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("missing S3 endpoint or bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	return &S3Store{
+		config: config,
+		client: &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+func (s *S3Store) objectPath(hash string) string {
+	segments := []string{s.config.Bucket}
+	if s.config.Prefix != "" {
+		segments = append(segments, strings.Split(s.config.Prefix, "/")...)
+	}
+	segments = append(segments, hash)
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *S3Store) sign(req *http.Request, payloadHash string) {
+	s.signAt(req, payloadHash, time.Now())
+}
+
+// signAt signs the host and every header set on the request so far.
+func (s *S3Store) signAt(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func (s *S3Store) do(ctx context.Context, method string, hash string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if err := validHash(hash); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.config.Endpoint+s.objectPath(hash), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s failed: %w", method, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, s3ErrorBodyLimit))
+		return nil, fmt.Errorf("S3 %s failed with %s: %s", method, resp.Status, message)
+	}
+	return resp, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, hash string, r io.Reader, size int64) error {
+	if _, err := s.Stat(ctx, hash); err == nil {
+		return nil
+	}
+	if size < 0 {
+		return fmt.Errorf("S3 uploads need the blob size")
+	}
+	resp, err := s.do(ctx, http.MethodPut, hash, r, size, hash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, hash string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, hash, nil, 0, s3EmptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, hash string) error {
+	resp, err := s.do(ctx, http.MethodDelete, hash, nil, 0, s3EmptyPayloadHash)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, hash string) (Info, error) {
+	resp, err := s.do(ctx, http.MethodHead, hash, nil, 0, s3EmptyPayloadHash)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+	return Info{Hash: hash, Size: resp.ContentLength}, nil
+}
@@ -7,20 +7,13 @@ import (
 	"fmt"
 )
 
-// GATEWAYS
+// DEFAULT GATEWAYS, overridden by the command line flags
 const (
 	ARWEAVE_URL        = "https://arweave.net"
 	BUNDLER_URL        = "https://node2.irys.xyz"
 	ACTIVATION_ADDRESS = "8vAopD3Fv7QnEqG00-E6aSyLaL9WKZpHmeTPWyNxs9c"
 )
 
-// TEST GATEWAYS
-// const (
-// 	BUNDLER_URL        = "https://devnet.irys.xyz"
-// 	ARWEAVE_URL        = "http://localhost:1984"
-// 	ACTIVATION_ADDRESS = "0S00yFATR2ozqXiq0XT6EjnB0EBc5xHW35HPZpSK1J8" // Only for Testing
-// )
-
 // TX VALUES
 const (
 	TX_APP_CONTENT_TYPE     = "application/json"
@@ -29,6 +22,10 @@ const (
 	TX_TYPE_POST            = "post"
 	TX_TYPE_PAYMENT         = "payment"
 	TX_TYPE_SET_PRICE       = "set-price"
+	TX_TYPE_SUBSCRIPTION    = "subscription"
+	TX_TYPE_SET_SUB_PRICE   = "set-subscription-price"
+	TX_TAG_SPLIT            = "Split"
+	TX_TAG_PERIOD           = "Period"
 	TX_POST_PRIVACY_PRIVATE = "PRIVATE"
 	TX_POST_PRIVACY_PUBLIC  = "PUBLIC"
 	TX_POST_TYPE_IMG        = "IMG"
@@ -40,6 +37,7 @@ type Owner struct {
 }
 
 type Block struct {
+	Height    int64 `json:"height"`
 	Timestamp int64 `json:"timestamp"`
 }
 
@@ -53,14 +51,26 @@ type Node struct {
 	Owner     Owner    `json:"owner,omitempty"`
 	Quantity  Quantity `json:"quantity,omitempty"`
 	Block     Block    `json:"block,omitempty"`
+	Tags      []Tag    `json:"tags,omitempty"`
+}
+
+type Tag struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type Edge struct {
-	Node Node `json:"node"`
+	Cursor string `json:"cursor,omitempty"`
+	Node   Node   `json:"node"`
+}
+
+type PageInfo struct {
+	HasNextPage bool `json:"hasNextPage"`
 }
 
 type Transactions struct {
-	Edges []Edge `json:"edges"`
+	PageInfo PageInfo `json:"pageInfo"`
+	Edges    []Edge   `json:"edges"`
 }
 
 type Data struct {
@@ -78,6 +88,9 @@ type Post struct {
 	Tags     *[]string     `json:"tags,omitempty"`
 	Uploader string        `json:"uploader"`
 	Price    *int32        `json:"price,omitempty"`
+	// Owner is the wallet that signed the transaction, read from the chain.
+	// The uploader is only what the post claims.
+	Owner string `json:"owner,omitempty"`
 }
 
 type PostContent struct {
@@ -2,6 +2,10 @@ package config
 
 import (
 	"flag"
+	"strings"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
 )
 
 type AppConfig struct {
@@ -10,6 +14,40 @@ type AppConfig struct {
 	NodeUDP   int
 	Bootstrap string
 	Group     string
+
+	MaxUploadSize int64
+	QuotaBytes    int64
+	QuotaImages   int64
+
+	UploadSessionDir     string
+	MaxUploadSessionSize int64
+
+	BlobDir    string
+	S3Endpoint string
+	S3Region   string
+	S3Bucket   string
+	S3Prefix   string
+
+	OrphanGrace    time.Duration
+	OrphanInterval time.Duration
+
+	ArweaveGateways   []string
+	BundlerGateways   []string
+	ActivationAddress string
+	ArweaveTimeout    time.Duration
+	ArweaveRetries    int
+	Confirmations     int
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	list := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
 }
 
 func Parse() AppConfig {
@@ -19,6 +57,26 @@ func Parse() AppConfig {
 	flag.IntVar(&conf.NodeUDP, "p-udp", 8078, "The port of the distributed node UDP interface.")
 	flag.StringVar(&conf.Bootstrap, "b", "", "The Multiaddress of the bootstrap node")
 	flag.StringVar(&conf.Group, "g", "", "The Topic of the Node Group.")
+	flag.Int64Var(&conf.MaxUploadSize, "max-upload", 2<<20, "The maximum size of an upload request in bytes.")
+	flag.Int64Var(&conf.QuotaBytes, "quota-bytes", 100<<20, "The storage quota of a wallet in bytes, 0 for unlimited.")
+	flag.Int64Var(&conf.QuotaImages, "quota-images", 1000, "The number of images a wallet can store, 0 for unlimited.")
+	flag.StringVar(&conf.UploadSessionDir, "upload-dir", "./uploads", "The directory of unfinished resumable uploads.")
+	flag.Int64Var(&conf.MaxUploadSessionSize, "max-resumable-upload", 64<<20, "The maximum size of a resumable upload in bytes.")
+	flag.StringVar(&conf.BlobDir, "blob-dir", "./blobs", "The directory of the image blobs.")
+	flag.StringVar(&conf.S3Endpoint, "s3-endpoint", "", "The URL of an S3-compatible service to store the image blobs in, instead of -blob-dir.")
+	flag.StringVar(&conf.S3Region, "s3-region", "us-east-1", "The region of the S3 bucket.")
+	flag.StringVar(&conf.S3Bucket, "s3-bucket", "", "The S3 bucket of the image blobs.")
+	flag.StringVar(&conf.S3Prefix, "s3-prefix", "", "The key prefix of the image blobs in the S3 bucket.")
+	flag.DurationVar(&conf.OrphanGrace, "orphan-grace", 72*time.Hour, "How long an upload may stay unreferenced by a post before it is purged.")
+	flag.DurationVar(&conf.OrphanInterval, "orphan-interval", 0, "How often orphaned uploads are purged, 0 to disable.")
+	arweaveGateways := flag.String("arweave-gateways", common.ARWEAVE_URL, "The Arweave gateways to query, comma separated, tried in order.")
+	bundlerGateways := flag.String("bundler-gateways", common.BUNDLER_URL, "The bundler gateways to read posts from, comma separated, tried in order.")
+	flag.StringVar(&conf.ActivationAddress, "activation-address", common.ACTIVATION_ADDRESS, "The address post prices are set with.")
+	flag.DurationVar(&conf.ArweaveTimeout, "arweave-timeout", 10*time.Second, "The timeout of a single gateway request.")
+	flag.IntVar(&conf.ArweaveRetries, "arweave-retries", 2, "How often failed gateway reads are retried.")
+	flag.IntVar(&conf.Confirmations, "payment-confirmations", 1, "How many blocks a payment needs before it grants access, 0 to accept pending payments.")
 	flag.Parse()
+	conf.ArweaveGateways = splitList(*arweaveGateways)
+	conf.BundlerGateways = splitList(*bundlerGateways)
 	return conf
 }
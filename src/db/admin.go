@@ -0,0 +1,169 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	ADMIN_ROLE_MODERATOR  = "moderator"
+	ADMIN_ROLE_SUPERADMIN = "superadmin"
+
+	DEFAULT_ADMIN_NAME = "default"
+)
+
+const (
+	createAdminNameIndexSQL = `CREATE UNIQUE INDEX IF NOT EXISTS admin_name ON admin (name);`
+
+	// The single admin row of older versions has no key, it is replaced by
+	// the identity bootstrapped from ADMIN_KEY.
+	deleteLegacyAdminSQL = `DELETE FROM admin WHERE key IS NULL;`
+)
+
+var adminRoleLevels = map[string]int{
+	ADMIN_ROLE_MODERATOR:  1,
+	ADMIN_ROLE_SUPERADMIN: 2,
+}
+
+type Admin struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Key  string `json:"key"`
+}
+
+func upgradeAdminTable(database *sql.DB) error {
+	if err := addColumnIfMissing(database, "admin", "name", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(database, "admin", "key", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := database.Exec(createAdminNameIndexSQL); err != nil {
+		return err
+	}
+	_, err := database.Exec(deleteLegacyAdminSQL)
+	return err
+}
+
+func IsValidAdminRole(role string) bool {
+	_, ok := adminRoleLevels[role]
+	return ok
+}
+
+// AdminRoleAllows reports whether the role grants at least the required
+// permissions. A superadmin may do everything a moderator may.
+func AdminRoleAllows(role string, required string) bool {
+	level, ok := adminRoleLevels[role]
+	if !ok {
+		return false
+	}
+	return level >= adminRoleLevels[required]
+}
+
+// EnsureAdmin makes sure the bootstrap identity exists as a superadmin, so a
+// fresh node can be administered before any admin was added through the API.
+func EnsureAdmin(name string, key string) error {
+	if key == "" {
+		return nil
+	}
+
+	query := `INSERT INTO admin (name, role, key) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET key = excluded.key`
+	_, err := Database.Exec(query, name, ADMIN_ROLE_SUPERADMIN, key)
+	if err != nil {
+		return fmt.Errorf("failed to bootstrap admin: %w", err)
+	}
+	return nil
+}
+
+func GetAdmin(name string) (Admin, error) {
+	query := `SELECT id, name, role, key FROM admin WHERE name = ?`
+
+	var admin Admin
+	err := Database.QueryRow(query, name).Scan(&admin.ID, &admin.Name, &admin.Role, &admin.Key)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Admin{}, fmt.Errorf("invalid admin")
+		}
+		fmt.Println(err)
+		return Admin{}, fmt.Errorf("database error")
+	}
+	return admin, nil
+}
+
+func GetAdmins() ([]Admin, error) {
+	query := `SELECT id, name, role, key FROM admin ORDER BY id`
+	rows, err := Database.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query admins: %w", err)
+	}
+	defer rows.Close()
+
+	admins := []Admin{}
+	for rows.Next() {
+		var admin Admin
+		err := rows.Scan(&admin.ID, &admin.Name, &admin.Role, &admin.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan admin: %w", err)
+		}
+		admins = append(admins, admin)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating admin rows: %w", err)
+	}
+
+	return admins, nil
+}
+
+func AddAdmin(name string, role string, key string) error {
+	if !IsValidAdminRole(role) {
+		return fmt.Errorf("invalid role %s", role)
+	}
+	query := `INSERT INTO admin (name, role, key) VALUES (?, ?, ?)`
+	_, err := Database.Exec(query, name, role, key)
+	if err != nil {
+		return fmt.Errorf("failed to add admin: %w", err)
+	}
+	return nil
+}
+
+func SetAdminRole(name string, role string) error {
+	if !IsValidAdminRole(role) {
+		return fmt.Errorf("invalid role %s", role)
+	}
+	result, err := Database.Exec(`UPDATE admin SET role = ? WHERE name = ?`, role, name)
+	if err != nil {
+		return fmt.Errorf("failed to set admin role: %w", err)
+	}
+	return expectAffected(result, "admin not found")
+}
+
+func RemoveAdmin(name string) error {
+	result, err := Database.Exec(`DELETE FROM admin WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to remove admin: %w", err)
+	}
+	return expectAffected(result, "admin not found")
+}
+
+func CountAdmins(role string) (int, error) {
+	var count int
+	err := Database.QueryRow(`SELECT COUNT(*) FROM admin WHERE role = ?`, role).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count admins: %w", err)
+	}
+	return count, nil
+}
+
+func expectAffected(result sql.Result, notFound string) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%s", notFound)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	API_SCOPE_UPLOAD         = "upload"
+	API_SCOPE_MANAGE         = "manage"
+	API_SCOPE_INFO           = "info:read"
+	API_SCOPE_FEEDBACK       = "feedback:write"
+	API_SCOPE_MESSAGES_READ  = "messages:read"
+	API_SCOPE_MESSAGES_WRITE = "messages:write"
+
+	API_KEY_PREFIX         = "vrk_"
+	API_KEY_BYTES          = 32
+	API_KEY_DISPLAY_LENGTH = 12
+	// last_used_at is only written once per interval, not on every request.
+	API_KEY_TOUCH_INTERVAL = time.Minute
+)
+
+var ApiScopes = []string{
+	API_SCOPE_UPLOAD,
+	API_SCOPE_MANAGE,
+	API_SCOPE_INFO,
+	API_SCOPE_FEEDBACK,
+	API_SCOPE_MESSAGES_READ,
+	API_SCOPE_MESSAGES_WRITE,
+}
+
+const (
+	createApiKeysTableSQL = `CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wallet TEXT NOT NULL,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL,
+		hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER,
+		revoked BOOLEAN NOT NULL DEFAULT FALSE
+	);`
+
+	createApiKeysIndexSQL = `CREATE INDEX IF NOT EXISTS api_keys_wallet ON api_keys (wallet);`
+)
+
+type ApiKey struct {
+	ID         int64      `json:"id"`
+	Wallet     string     `json:"wallet"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+func (key ApiKey) HasScope(scope string) bool {
+	for _, s := range key.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidApiScope(scope string) bool {
+	for _, s := range ApiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func createApiKeyTables(database *sql.DB) error {
+	for _, query := range []string{
+		createApiKeysTableSQL,
+		createApiKeysIndexSQL,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanApiKey(row interface{ Scan(...any) error }) (ApiKey, error) {
+	var key ApiKey
+	var scopes string
+	var createdAt int64
+	var lastUsedAt sql.NullInt64
+	err := row.Scan(&key.ID, &key.Wallet, &key.Name, &key.Prefix, &scopes, &createdAt, &lastUsedAt)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsedAt.Valid {
+		lastUsed := time.Unix(lastUsedAt.Int64, 0)
+		key.LastUsedAt = &lastUsed
+	}
+	return key, nil
+}
+
+const selectApiKeyColumns = `id, wallet, name, prefix, scopes, created_at, last_used_at`
+
+// CreateApiKey stores a new API key and returns it together with the secret,
+// which is not stored and can't be shown again.
+func CreateApiKey(wallet string, name string, scopes []string) (ApiKey, string, error) {
+	for _, scope := range scopes {
+		if !IsValidApiScope(scope) {
+			return ApiKey{}, "", fmt.Errorf("invalid scope %s", scope)
+		}
+	}
+
+	data, err := randomBytes(API_KEY_BYTES)
+	if err != nil {
+		return ApiKey{}, "", fmt.Errorf("failed to generate api key: %w", err)
+	}
+	secret := API_KEY_PREFIX + base64.RawURLEncoding.EncodeToString(data)
+
+	key := ApiKey{
+		Wallet:    wallet,
+		Name:      name,
+		Prefix:    secret[:API_KEY_DISPLAY_LENGTH],
+		Scopes:    scopes,
+		CreatedAt: time.Unix(time.Now().Unix(), 0),
+	}
+
+	query := `INSERT INTO api_keys (wallet, name, prefix, hash, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := Database.Exec(query, wallet, name, key.Prefix, hashToken(secret), strings.Join(scopes, ","), key.CreatedAt.Unix())
+	if err != nil {
+		return ApiKey{}, "", fmt.Errorf("failed to store api key: %w", err)
+	}
+	key.ID, err = result.LastInsertId()
+	if err != nil {
+		return ApiKey{}, "", fmt.Errorf("failed to get api key ID: %w", err)
+	}
+
+	return key, secret, nil
+}
+
+// GetApiKeyBySecret returns the active API key matching the secret and
+// records its use.
+func GetApiKeyBySecret(secret string) (ApiKey, error) {
+	query := `SELECT ` + selectApiKeyColumns + ` FROM api_keys WHERE hash = ? AND revoked = FALSE`
+	key, err := scanApiKey(Database.QueryRow(query, hashToken(secret)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return ApiKey{}, fmt.Errorf("invalid api key")
+		}
+		return ApiKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > API_KEY_TOUCH_INTERVAL {
+		_, err = Database.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, now.Unix(), key.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return key, nil
+}
+
+func GetApiKeys(wallet string) ([]ApiKey, error) {
+	query := `SELECT ` + selectApiKeyColumns + ` FROM api_keys WHERE wallet = ? AND revoked = FALSE ORDER BY id`
+	rows, err := Database.Query(query, wallet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []ApiKey{}
+	for rows.Next() {
+		key, err := scanApiKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating api key rows: %w", err)
+	}
+
+	return keys, nil
+}
+
+func RevokeApiKey(wallet string, id int64) error {
+	result, err := Database.Exec(`UPDATE api_keys SET revoked = TRUE WHERE wallet = ? AND id = ? AND revoked = FALSE`, wallet, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	return expectAffected(result, "api key not found")
+}
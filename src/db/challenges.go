@@ -0,0 +1,224 @@
+package db
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	CHALLENGE_PURPOSE_LOGIN        = "login"
+	CHALLENGE_PURPOSE_LOGIN_SIGN   = "login-sign"
+	CHALLENGE_PURPOSE_ADMIN_LOGIN  = "admin-login"
+	CHALLENGE_PURPOSE_KEY_ROTATION = "key-rotation"
+	CHALLENGE_PURPOSE_IMAGE_DELETE = "image-delete"
+
+	CHALLENGE_TTL             = 5 * time.Minute
+	CHALLENGE_MAX_OUTSTANDING = 5
+	CHALLENGE_BYTES           = 32
+)
+
+const (
+	createChallengesTableSQL = `CREATE TABLE IF NOT EXISTS challenges (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		wallet TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		value TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`
+
+	createChallengesIndexSQL = `CREATE INDEX IF NOT EXISTS challenges_wallet_purpose ON challenges (wallet, purpose);`
+
+	createChallengeFailuresTableSQL = `CREATE TABLE IF NOT EXISTS challenge_failures (
+		wallet TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_failed_at INTEGER NOT NULL,
+		PRIMARY KEY (wallet, purpose)
+	);`
+)
+
+// Challenge is a single use nonce. Subject is the thumbprint of the key a
+// login challenge was encrypted for.
+type Challenge struct {
+	ID        int64
+	Wallet    string
+	Purpose   string
+	Value     string
+	Subject   string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+func createChallengeTables(database *sql.DB) error {
+	for _, query := range []string{
+		createChallengesTableSQL,
+		createChallengesIndexSQL,
+		createChallengeFailuresTableSQL,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upgradeChallengesTable(database *sql.DB) error {
+	return addColumnIfMissing(database, "challenges", "subject", "TEXT")
+}
+
+func generateChal() (string, error) {
+	data, err := randomBytes(CHALLENGE_BYTES)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// CreateChallenge stores a new single use challenge for the wallet. Only the
+// newest CHALLENGE_MAX_OUTSTANDING challenges per purpose are kept.
+func CreateChallenge(wallet string, purpose string) (string, error) {
+	return CreateKeyChallenge(wallet, purpose, "")
+}
+
+// CreateKeyChallenge stores a challenge meant for one key of the wallet.
+func CreateKeyChallenge(wallet string, purpose string, subject string) (string, error) {
+	value, err := generateChal()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	now := time.Now()
+	query := `INSERT INTO challenges (wallet, purpose, value, subject, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = Database.Exec(query, wallet, purpose, value, subject, now.Unix(), now.Add(CHALLENGE_TTL).Unix())
+	if err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+
+	query = `DELETE FROM challenges WHERE wallet = ? AND purpose = ? AND id NOT IN (
+		SELECT id FROM challenges WHERE wallet = ? AND purpose = ? ORDER BY id DESC LIMIT ?
+	)`
+	_, err = Database.Exec(query, wallet, purpose, wallet, purpose, CHALLENGE_MAX_OUTSTANDING)
+	if err != nil {
+		return "", fmt.Errorf("failed to trim challenges: %w", err)
+	}
+
+	return value, nil
+}
+
+// GetChallenges returns the outstanding, not yet expired challenges.
+func GetChallenges(wallet string, purpose string) ([]Challenge, error) {
+	query := `SELECT id, wallet, purpose, value, COALESCE(subject, ''), created_at, expires_at FROM challenges
+		WHERE wallet = ? AND purpose = ? AND expires_at > ? ORDER BY id DESC`
+	rows, err := Database.Query(query, wallet, purpose, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query challenges: %w", err)
+	}
+	defer rows.Close()
+
+	var challenges []Challenge
+	for rows.Next() {
+		var chal Challenge
+		var createdAt, expiresAt int64
+		err := rows.Scan(&chal.ID, &chal.Wallet, &chal.Purpose, &chal.Value, &chal.Subject, &createdAt, &expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan challenge: %w", err)
+		}
+		chal.CreatedAt = time.Unix(createdAt, 0)
+		chal.ExpiresAt = time.Unix(expiresAt, 0)
+		challenges = append(challenges, chal)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating challenge rows: %w", err)
+	}
+
+	return challenges, nil
+}
+
+// ConsumeChallenge checks the submitted value against the outstanding
+// challenges. A matching challenge is deleted and returned, a wrong value
+// burns all outstanding challenges of the purpose and is recorded as a
+// failure.
+func ConsumeChallenge(wallet string, purpose string, value string) (Challenge, error) {
+	challenges, err := GetChallenges(wallet, purpose)
+	if err != nil {
+		return Challenge{}, err
+	}
+
+	for _, chal := range challenges {
+		if subtle.ConstantTimeCompare([]byte(chal.Value), []byte(value)) == 1 {
+			return chal, UseChallenge(chal)
+		}
+	}
+
+	if err := FailChallenges(wallet, purpose); err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{}, fmt.Errorf("invalid challenge")
+}
+
+// UseChallenge deletes a successfully answered challenge and clears the
+// failure counter of the wallet.
+func UseChallenge(chal Challenge) error {
+	result, err := Database.Exec(`DELETE FROM challenges WHERE id = ?`, chal.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete challenge: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("challenge already used")
+	}
+
+	_, err = Database.Exec(`DELETE FROM challenge_failures WHERE wallet = ? AND purpose = ?`, chal.Wallet, chal.Purpose)
+	if err != nil {
+		return fmt.Errorf("failed to reset challenge failures: %w", err)
+	}
+	return nil
+}
+
+// FailChallenges deletes every outstanding challenge of the purpose and
+// increments the failed attempt counter of the wallet.
+func FailChallenges(wallet string, purpose string) error {
+	_, err := Database.Exec(`DELETE FROM challenges WHERE wallet = ? AND purpose = ?`, wallet, purpose)
+	if err != nil {
+		return fmt.Errorf("failed to delete challenges: %w", err)
+	}
+
+	query := `INSERT INTO challenge_failures (wallet, purpose, attempts, last_failed_at) VALUES (?, ?, 1, ?)
+		ON CONFLICT (wallet, purpose) DO UPDATE SET attempts = attempts + 1, last_failed_at = excluded.last_failed_at`
+	_, err = Database.Exec(query, wallet, purpose, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record challenge failure: %w", err)
+	}
+	return nil
+}
+
+func GetChallengeFailures(wallet string, purpose string) (int, time.Time, error) {
+	query := `SELECT attempts, last_failed_at FROM challenge_failures WHERE wallet = ? AND purpose = ?`
+
+	var attempts int
+	var lastFailedAt int64
+	err := Database.QueryRow(query, wallet, purpose).Scan(&attempts, &lastFailedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, time.Time{}, nil
+		}
+		return 0, time.Time{}, fmt.Errorf("failed to get challenge failures: %w", err)
+	}
+	return attempts, time.Unix(lastFailedAt, 0), nil
+}
+
+func DeleteExpiredChallenges() (int64, error) {
+	result, err := Database.Exec(`DELETE FROM challenges WHERE expires_at <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired challenges: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -3,8 +3,6 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	"math/rand"
-	"strconv"
 	"strings"
 	"time"
 
@@ -16,8 +14,17 @@ const (
 		id INTEGER PRIMARY KEY,
 		wallet TEXT,
 		post TEXT,
-		data BLOB,
-		active BOOLEAN
+		hash TEXT,
+		size INTEGER,
+		mime TEXT,
+		width INTEGER,
+		height INTEGER,
+		teaser BOOLEAN DEFAULT TRUE,
+		teaser_hash TEXT,
+		blurhash TEXT,
+		stripped TEXT,
+		created_at INTEGER,
+		active BOOLEAN DEFAULT TRUE
 	);`
 
 	createKeysTableSQL = `CREATE TABLE IF NOT EXISTS keys (
@@ -49,25 +56,16 @@ const (
         message TEXT NOT NULL,
         timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
     );`
-
-	checkImagesColumnsSQL = `PRAGMA table_info(images);`
-
-	initAdminTableSQL = `INSERT OR REPLACE INTO admin (
-		id,
-		role,
-		chal
-	) VALUES (
-	 	(SELECT id FROM admin WHERE role = 'admin'),
-		'admin',
-		NULL
-	);`
 )
 
 type UserKey struct {
-	ID       int    `json:"id"`
-	WalletID string `json:"wallet"`
-	Key      string `json:"key"`
-	Chal     string `json:"chal"`
+	ID        int    `json:"id"`
+	WalletID  string `json:"wallet"`
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+	Proof     string `json:"-"`
+	Cached    bool   `json:"-"`
 }
 
 type Feedback struct {
@@ -88,15 +86,13 @@ type InboxMessage struct {
 
 var Database *sql.DB
 
-func upgrade(database *sql.DB) (*sql.DB, error) {
-	query := checkImagesColumnsSQL
-	rows, err := database.Query(query)
+func hasColumn(database *sql.DB, table string, column string) (bool, error) {
+	rows, err := database.Query(fmt.Sprintf(`PRAGMA table_info(%s);`, table))
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	defer rows.Close()
 
-	columnExists := false
 	for rows.Next() {
 		var cid int
 		var name, ctype string
@@ -104,20 +100,56 @@ func upgrade(database *sql.DB) (*sql.DB, error) {
 		var dflt_value interface{}
 		err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt_value, &pk)
 		if err != nil {
-			return nil, err
+			return false, err
 		}
-		if name == "active" {
-			columnExists = true
-			break
+		if name == column {
+			return true, nil
 		}
 	}
-	if !columnExists {
-		alterQuery := `ALTER TABLE images ADD COLUMN active BOOLEAN DEFAULT TRUE;`
-		_, err = database.Exec(alterQuery)
-		if err != nil {
-			return nil, err
-		}
+	return false, rows.Err()
+}
+
+func addColumnIfMissing(database *sql.DB, table string, column string, definition string) error {
+	exists, err := hasColumn(database, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = database.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s;`, table, column, definition))
+	return err
+}
+
+func upgrade(database *sql.DB) (*sql.DB, error) {
+	err := upgradeImagesTable(database)
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgradeAdminTable(database)
+	if err != nil {
+		return nil, err
 	}
+
+	err = upgradeKeysTable(database)
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgradeSessionsTable(database)
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgradeChallengesTable(database)
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgradeTxCacheTable(database)
+	if err != nil {
+		return nil, err
+	}
+
 	return database, nil
 }
 
@@ -153,116 +185,87 @@ func Create() (*sql.DB, error) {
 		return nil, err
 	}
 
-	database, err = upgrade(database)
+	err = createChallengeTables(database)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = database.Exec(initAdminTableSQL)
+	err = createSessionTables(database)
 	if err != nil {
 		return nil, err
 	}
 
-	return database, nil
-}
-
-func GetUserKey(wallet string) (UserKey, error) {
-	selectUserQuery := "SELECT id, wallet, key, chal FROM keys WHERE wallet = ?"
-
-	var storedUser UserKey
-	row := Database.QueryRow(selectUserQuery, wallet)
-	err := row.Scan(&storedUser.ID, &storedUser.WalletID, &storedUser.Key, &storedUser.Chal)
+	err = createSigningKeyTables(database)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return UserKey{}, fmt.Errorf("invalid Wallet ID")
-		}
-		fmt.Println(err)
-		return UserKey{}, fmt.Errorf("database error")
+		return nil, err
 	}
 
-	return storedUser, nil
-}
-
-func InsertUserKey(wallet string, key string) (string, error) {
-	insertUserSQL := `INSERT INTO keys (wallet, key, chal) VALUES (?, ?, ?)`
-
-	stmt, err := Database.Prepare(insertUserSQL)
+	err = createApiKeyTables(database)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer stmt.Close()
 
-	newChal := generateChal()
+	err = createImageVariantTables(database)
+	if err != nil {
+		return nil, err
+	}
 
-	_, err = stmt.Exec(wallet, key, newChal)
+	err = createImageTombstoneTables(database)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return newChal, nil
-}
+	err = createUploadSessionTables(database)
+	if err != nil {
+		return nil, err
+	}
 
-func generateChal() string {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	randomNumber := r.Intn(1000000)
-	return strconv.Itoa(randomNumber)
-}
+	err = createTxCacheTables(database)
+	if err != nil {
+		return nil, err
+	}
 
-func SetNewChal(wallet string) (string, error) {
-	newChal := generateChal()
+	err = createEntitlementTables(database)
+	if err != nil {
+		return nil, err
+	}
 
-	query := `UPDATE keys SET chal = ? WHERE wallet = ?`
-	_, err := Database.Exec(query, newChal, wallet)
+	err = createSubscriptionTables(database)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return newChal, nil
-}
 
-func SetAdminChal() (string, error) {
-	newChal := generateChal()
+	err = createKeyRevocationTables(database)
+	if err != nil {
+		return nil, err
+	}
 
-	query := `UPDATE admin SET chal = ? WHERE role = "admin"`
-	_, err := Database.Exec(query, newChal)
+	database, err = upgrade(database)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return newChal, nil
+
+	return database, nil
 }
 
-func GetAdminChal() (string, error) {
-	selectUserQuery := `SELECT chal FROM admin WHERE role = "admin"`
+// GetUserKey returns the oldest active key of the wallet.
+func GetUserKey(wallet string) (UserKey, error) {
+	selectUserQuery := `SELECT ` + selectUserKeyColumns + ` FROM keys WHERE wallet = ? AND revoked = FALSE ORDER BY id LIMIT 1`
 
-	var chal string
-	row := Database.QueryRow(selectUserQuery)
-	err := row.Scan(&chal)
+	storedUser, err := scanUserKey(Database.QueryRow(selectUserQuery, wallet))
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return "", fmt.Errorf("invalid Wallet ID")
+			return UserKey{}, fmt.Errorf("invalid Wallet ID")
 		}
 		fmt.Println(err)
-		return "", fmt.Errorf("database error")
+		return UserKey{}, fmt.Errorf("database error")
 	}
 
-	return chal, nil
-}
-
-func ResetAdminChal() error {
-	query := `UPDATE admin SET chal = "" WHERE role="admin"`
-	_, err := Database.Exec(query)
-	if err != nil {
-		return err
-	}
-	return nil
+	return storedUser, nil
 }
 
-func DeleteChal(wallet string) error {
-	query := `UPDATE keys SET chal = ? WHERE wallet = ?`
-	_, err := Database.Exec(query, "", wallet)
-	if err != nil {
-		return err
-	}
-	return nil
+func InsertUserKey(wallet string, key string) error {
+	return AddUserKey(wallet, key, "", "")
 }
 
 func AddFeedback(feedback Feedback) error {
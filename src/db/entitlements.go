@@ -0,0 +1,105 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// An entitlement records a verified payment of a buyer for the private
+// content of a post, so it isn't checked on Arweave on every view.
+const createEntitlementsTableSQL = `CREATE TABLE IF NOT EXISTS entitlements (
+	buyer TEXT NOT NULL,
+	uploader TEXT NOT NULL,
+	post TEXT NOT NULL,
+	post_tx TEXT NOT NULL,
+	payment_tx TEXT NOT NULL,
+	amount TEXT NOT NULL,
+	verified_at INTEGER NOT NULL,
+	PRIMARY KEY (buyer, uploader, post)
+);`
+
+type Entitlement struct {
+	Buyer      string `json:"buyer"`
+	Uploader   string `json:"uploader"`
+	Post       string `json:"postId"`
+	PostTx     string `json:"postTx"`
+	PaymentTx  string `json:"paymentTx"`
+	Amount     string `json:"amount"`
+	VerifiedAt int64  `json:"verifiedAt"`
+}
+
+const selectEntitlementColumns = `buyer, uploader, post, post_tx, payment_tx, amount, verified_at`
+
+func createEntitlementTables(database *sql.DB) error {
+	_, err := database.Exec(createEntitlementsTableSQL)
+	return err
+}
+
+func scanEntitlements(rows *sql.Rows) ([]Entitlement, error) {
+	defer rows.Close()
+
+	entitlements := []Entitlement{}
+	for rows.Next() {
+		var entitlement Entitlement
+		err := rows.Scan(&entitlement.Buyer, &entitlement.Uploader, &entitlement.Post, &entitlement.PostTx,
+			&entitlement.PaymentTx, &entitlement.Amount, &entitlement.VerifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan entitlement: %w", err)
+		}
+		entitlements = append(entitlements, entitlement)
+	}
+	return entitlements, rows.Err()
+}
+
+func HasEntitlement(buyer string, uploader string, post string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM entitlements WHERE buyer = ? AND uploader = ? AND post = ?`
+	if err := Database.QueryRow(query, buyer, uploader, post).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check entitlement: %w", err)
+	}
+	return count > 0, nil
+}
+
+// AddEntitlement records a verified payment, a later verification of the
+// same post replaces the earlier one.
+func AddEntitlement(entitlement Entitlement) error {
+	if entitlement.VerifiedAt == 0 {
+		entitlement.VerifiedAt = time.Now().Unix()
+	}
+	query := `INSERT OR REPLACE INTO entitlements (` + selectEntitlementColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := Database.Exec(query, entitlement.Buyer, entitlement.Uploader, entitlement.Post, entitlement.PostTx,
+		entitlement.PaymentTx, entitlement.Amount, entitlement.VerifiedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store entitlement: %w", err)
+	}
+	return nil
+}
+
+// GetEntitlements lists the purchases of the buyer, the latest verified
+// first.
+func GetEntitlements(buyer string) ([]Entitlement, error) {
+	query := `SELECT ` + selectEntitlementColumns + ` FROM entitlements WHERE buyer = ? ORDER BY verified_at DESC`
+	rows, err := Database.Query(query, buyer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get entitlements: %w", err)
+	}
+	return scanEntitlements(rows)
+}
+
+func GetAllEntitlements() ([]Entitlement, error) {
+	query := `SELECT ` + selectEntitlementColumns + ` FROM entitlements ORDER BY verified_at`
+	rows, err := Database.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get entitlements: %w", err)
+	}
+	return scanEntitlements(rows)
+}
+
+func DeleteEntitlement(buyer string, uploader string, post string) error {
+	query := `DELETE FROM entitlements WHERE buyer = ? AND uploader = ? AND post = ?`
+	if _, err := Database.Exec(query, buyer, uploader, post); err != nil {
+		return fmt.Errorf("failed to delete entitlement: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,531 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/blob"
+	"github.com/acsermely/veracy.server/src/media"
+)
+
+var (
+	ErrImageNotFound   = errors.New("image not found")
+	ErrImageCountQuota = errors.New("image count quota exceeded")
+	ErrImageBytesQuota = errors.New("storage quota exceeded")
+)
+
+// Blobs holds the content of the images, the images table only keeps their
+// metadata and content hash.
+var Blobs blob.Store
+
+// ImageQuota limits the images stored for a single wallet, zero means
+// unlimited.
+type ImageQuota struct {
+	Bytes  int64 `json:"bytes"`
+	Images int64 `json:"images"`
+}
+
+type ImageUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Images int64 `json:"images"`
+}
+
+type Image struct {
+	ID     int64  `json:"id"`
+	Wallet string `json:"address"`
+	Post   string `json:"postId"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Mime   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Teaser tells whether unpaid viewers of a private image get a blurred
+	// preview, chosen by the creator.
+	Teaser     bool   `json:"teaser"`
+	TeaserHash string `json:"-"`
+	BlurHash   string `json:"blurHash"`
+	// Stripped reports the metadata removed from the upload.
+	Stripped  *media.StripReport `json:"stripped,omitempty"`
+	CreatedAt int64              `json:"createdAt"`
+	Active    bool               `json:"active"`
+}
+
+const selectImageColumns = `id, wallet, post, hash, size, mime, width, height, COALESCE(teaser, TRUE), teaser_hash, blurhash, stripped, COALESCE(created_at, 0), COALESCE(active, TRUE)`
+
+func upgradeImagesTable(database *sql.DB) error {
+	err := addColumnIfMissing(database, "images", "active", "BOOLEAN DEFAULT TRUE")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "images", "size", "INTEGER")
+	if err != nil {
+		return err
+	}
+
+	err = addColumnIfMissing(database, "images", "hash", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{"mime TEXT", "width INTEGER", "height INTEGER", "teaser BOOLEAN DEFAULT TRUE", "teaser_hash TEXT", "blurhash TEXT", "stripped TEXT", "created_at INTEGER"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := addColumnIfMissing(database, "images", name, definition); err != nil {
+			return err
+		}
+	}
+
+	// Images stored before uploads were dated count from the upgrade, so the
+	// orphan grace period protects them like fresh uploads.
+	_, err = database.Exec(`UPDATE images SET created_at = ? WHERE created_at IS NULL OR created_at = 0`, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec(`CREATE INDEX IF NOT EXISTS images_wallet ON images (wallet);`)
+	if err != nil {
+		return err
+	}
+	_, err = database.Exec(`CREATE INDEX IF NOT EXISTS images_hash ON images (hash);`)
+	return err
+}
+
+// InitBlobs sets the blob store of the images and moves the content still
+// kept in the legacy data column into it. The column is dropped once every
+// row has been moved.
+func InitBlobs(store blob.Store) error {
+	Blobs = store
+
+	legacy, err := hasColumn(Database, "images", "data")
+	if err != nil {
+		return err
+	}
+	if legacy {
+		if err := moveLegacyImages(store); err != nil {
+			return err
+		}
+	}
+
+	return normalizeLegacyImages(context.Background())
+}
+
+func moveLegacyImages(store blob.Store) error {
+
+	rows, err := Database.Query(`SELECT id FROM images WHERE data IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to query legacy images: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan legacy image: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error iterating legacy image rows: %w", err)
+	}
+
+	for _, id := range ids {
+		var data []byte
+		err := Database.QueryRow(`SELECT data FROM images WHERE id = ?`, id).Scan(&data)
+		if err != nil {
+			return fmt.Errorf("failed to read legacy image %d: %w", id, err)
+		}
+		hash := blob.Hash(data)
+		if err := store.Put(context.Background(), hash, bytes.NewReader(data), int64(len(data))); err != nil {
+			return fmt.Errorf("failed to move image %d: %w", id, err)
+		}
+		_, err = Database.Exec(`UPDATE images SET hash = ?, size = ?, data = NULL WHERE id = ?`, hash, len(data), id)
+		if err != nil {
+			return fmt.Errorf("failed to update image %d: %w", id, err)
+		}
+	}
+	if len(ids) > 0 {
+		fmt.Printf("Moved %d images to the blob store\n", len(ids))
+	}
+
+	_, err = Database.Exec(`ALTER TABLE images DROP COLUMN data`)
+	if err != nil {
+		return fmt.Errorf("failed to drop legacy image data: %w", err)
+	}
+	_, err = Database.Exec(`VACUUM`)
+	return err
+}
+
+func scanImage(row interface{ Scan(...any) error }) (Image, error) {
+	var image Image
+	var hash, mime, teaserHash, blurHash, stripped sql.NullString
+	var size, width, height sql.NullInt64
+	err := row.Scan(&image.ID, &image.Wallet, &image.Post, &hash, &size, &mime, &width, &height, &image.Teaser, &teaserHash, &blurHash, &stripped, &image.CreatedAt, &image.Active)
+	if err != nil {
+		return Image{}, err
+	}
+	if stripped.Valid {
+		image.Stripped = &media.StripReport{}
+		if err := json.Unmarshal([]byte(stripped.String), image.Stripped); err != nil {
+			return Image{}, fmt.Errorf("invalid strip report: %w", err)
+		}
+	}
+	image.Hash = hash.String
+	image.TeaserHash = teaserHash.String
+	image.BlurHash = blurHash.String
+	image.Size = size.Int64
+	image.Mime = mime.String
+	image.Width = int(width.Int64)
+	image.Height = int(height.Int64)
+	return image, nil
+}
+
+func GetImage(id int64, post string, wallet string) (Image, error) {
+	query := `SELECT ` + selectImageColumns + ` FROM images WHERE id = ? AND post = ? AND wallet = ?`
+	image, err := scanImage(Database.QueryRow(query, id, post, wallet))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Image{}, ErrImageNotFound
+		}
+		return Image{}, fmt.Errorf("failed to get image: %w", err)
+	}
+	return image, nil
+}
+
+func GetAllImages() ([]Image, error) {
+	rows, err := Database.Query(`SELECT ` + selectImageColumns + ` FROM images`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, image)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating image rows: %w", err)
+	}
+
+	return images, nil
+}
+
+// GetImagesCreatedBefore returns the images uploaded before the time.
+// Images of older versions have no upload time and are always included.
+func GetImagesCreatedBefore(before time.Time) ([]Image, error) {
+	query := `SELECT ` + selectImageColumns + ` FROM images WHERE COALESCE(created_at, 0) < ? ORDER BY wallet, id`
+	rows, err := Database.Query(query, before.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating image rows: %w", err)
+	}
+
+	return images, nil
+}
+
+// ImageFilter narrows the images of a wallet. Zero values don't filter,
+// Before pages through the images from the newest one.
+type ImageFilter struct {
+	Post   string
+	Active *bool
+	Since  int64
+	Until  int64
+	Before int64
+	Limit  int
+}
+
+// GetWalletImages returns the images of the wallet matching the filter, the
+// newest first.
+func GetWalletImages(wallet string, filter ImageFilter) ([]Image, error) {
+	query := `SELECT ` + selectImageColumns + ` FROM images WHERE wallet = ?`
+	args := []any{wallet}
+	if filter.Post != "" {
+		query += ` AND post = ?`
+		args = append(args, filter.Post)
+	}
+	if filter.Active != nil {
+		query += ` AND COALESCE(active, TRUE) = ?`
+		args = append(args, *filter.Active)
+	}
+	if filter.Since != 0 {
+		query += ` AND COALESCE(created_at, 0) >= ?`
+		args = append(args, filter.Since)
+	}
+	if filter.Until != 0 {
+		query += ` AND COALESCE(created_at, 0) < ?`
+		args = append(args, filter.Until)
+	}
+	if filter.Before != 0 {
+		query += ` AND id < ?`
+		args = append(args, filter.Before)
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := Database.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query images: %w", err)
+	}
+	defer rows.Close()
+
+	images := []Image{}
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		images = append(images, image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating image rows: %w", err)
+	}
+
+	return images, nil
+}
+
+// WalletPost is a post of a wallet with the id of its newest image.
+type WalletPost struct {
+	Post   string
+	Newest int64
+}
+
+// GetWalletPosts returns the posts of the wallet, the one with the newest
+// image first. Before pages through them by the newest image id.
+func GetWalletPosts(wallet string, before int64, limit int) ([]WalletPost, error) {
+	query := `SELECT post, MAX(id) AS newest FROM images WHERE wallet = ? GROUP BY post`
+	args := []any{wallet}
+	if before != 0 {
+		query += ` HAVING newest < ?`
+		args = append(args, before)
+	}
+	query += ` ORDER BY newest DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := Database.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query posts: %w", err)
+	}
+	defer rows.Close()
+
+	posts := []WalletPost{}
+	for rows.Next() {
+		var post WalletPost
+		if err := rows.Scan(&post.Post, &post.Newest); err != nil {
+			return nil, fmt.Errorf("failed to scan post: %w", err)
+		}
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating post rows: %w", err)
+	}
+
+	return posts, nil
+}
+
+// FullID is the id posts refer to the image with.
+func (image Image) FullID() string {
+	return fmt.Sprintf("%s:%s:%d", image.Wallet, image.Post, image.ID)
+}
+
+// ReadImage returns the content of a stored image.
+func ReadImage(ctx context.Context, image Image) ([]byte, error) {
+	if image.Hash == "" {
+		return nil, ErrImageNotFound
+	}
+	return blob.ReadAll(ctx, Blobs, image.Hash)
+}
+
+func GetImageUsage(wallet string) (ImageUsage, error) {
+	var usage ImageUsage
+	query := `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images WHERE wallet = ?`
+	err := Database.QueryRow(query, wallet).Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return ImageUsage{}, fmt.Errorf("failed to get image usage: %w", err)
+	}
+	return usage, nil
+}
+
+// CheckImageQuota tells early whether an upload of the size still fits. It
+// is only a hint to skip storing the content, InsertImage enforces the quota.
+func CheckImageQuota(wallet string, size int64, quota ImageQuota) error {
+	usage, err := GetImageUsage(wallet)
+	if err != nil {
+		return err
+	}
+	if quota.Images != 0 && usage.Images >= quota.Images {
+		return ErrImageCountQuota
+	}
+	if quota.Bytes != 0 && usage.Bytes+size > quota.Bytes {
+		return ErrImageBytesQuota
+	}
+	return nil
+}
+
+// InsertImage records an image whose content is already in the blob store,
+// if it fits into the quota of the wallet. The quota is checked in the same
+// statement as the insert, so concurrent uploads can't overshoot it.
+func InsertImage(image Image, quota ImageQuota) (int64, error) {
+	var stripped sql.NullString
+	if image.Stripped != nil {
+		report, err := json.Marshal(image.Stripped)
+		if err != nil {
+			return 0, err
+		}
+		stripped = sql.NullString{String: string(report), Valid: true}
+	}
+
+	// Ids of deleted images are not given out again, their tombstones would
+	// hide the new image.
+	query := `INSERT INTO images (id, wallet, post, hash, size, mime, width, height, teaser, stripped, created_at, active)
+		SELECT MAX(COALESCE((SELECT MAX(id) FROM images), 0), COALESCE((SELECT MAX(image_id) FROM image_tombstones), 0)) + 1,
+			?, ?, ?, ?, ?, ?, ?, ?, ?, ?, TRUE
+		WHERE (? = 0 OR (SELECT COUNT(*) FROM images WHERE wallet = ?) < ?)
+		AND (? = 0 OR (SELECT COALESCE(SUM(size), 0) FROM images WHERE wallet = ?) + ? <= ?)`
+	result, err := Database.Exec(query,
+		image.Wallet, image.Post, image.Hash, image.Size, image.Mime, image.Width, image.Height, image.Teaser, stripped, time.Now().Unix(),
+		quota.Images, image.Wallet, quota.Images,
+		quota.Bytes, image.Wallet, image.Size, quota.Bytes,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store image: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error checking affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		if err := CheckImageQuota(image.Wallet, image.Size, quota); err != nil {
+			return 0, err
+		}
+		return 0, ErrImageBytesQuota
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get image ID: %w", err)
+	}
+	return id, nil
+}
+
+// isBlobUsed tells whether any image, teaser or variant still refers to the
+// blob.
+func isBlobUsed(hash string) (bool, error) {
+	var count int
+	query := `SELECT
+		(SELECT COUNT(*) FROM images WHERE hash = ? OR teaser_hash = ?) +
+		(SELECT COUNT(*) FROM image_variants WHERE variant_hash = ?)`
+	err := Database.QueryRow(query, hash, hash, hash).Scan(&count)
+	return count > 0, err
+}
+
+// decodeLegacyImage decodes a data URL image and strips its metadata like
+// the one of a new upload.
+func decodeLegacyImage(content []byte) (media.Info, []byte, *media.StripReport, error) {
+	data, err := media.ParseDataURL(string(content))
+	if err != nil {
+		return media.Info{}, nil, nil, err
+	}
+	info, err := media.Inspect(bytes.NewReader(data))
+	if err != nil || !media.CanStrip(info.Mime) {
+		return info, data, nil, err
+	}
+
+	var stripped bytes.Buffer
+	report, err := media.StripMetadata(bytes.NewReader(data), &stripped, info.Mime)
+	if err != nil {
+		return media.Info{}, nil, nil, err
+	}
+	// Rotating swaps the dimensions, so they are read again.
+	info, err = media.Inspect(bytes.NewReader(stripped.Bytes()))
+	return info, stripped.Bytes(), &report, err
+}
+
+// normalizeLegacyImages decodes the images that older clients uploaded as
+// data URLs and stores their binary content instead, so they are served with
+// a proper content type and without metadata like new uploads. Content that
+// isn't a valid image is left as it is.
+func normalizeLegacyImages(ctx context.Context) error {
+	rows, err := Database.Query(`SELECT ` + selectImageColumns + ` FROM images WHERE mime IS NULL AND hash IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to query legacy images: %w", err)
+	}
+	var images []Image
+	for rows.Next() {
+		image, err := scanImage(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan legacy image: %w", err)
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+
+	normalized := 0
+	for _, image := range images {
+		content, err := ReadImage(ctx, image)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		info, data, report, err := decodeLegacyImage(content)
+		if err != nil {
+			// An empty type marks the image as checked, it is served as stored.
+			Database.Exec(`UPDATE images SET mime = '' WHERE id = ?`, image.ID)
+			continue
+		}
+		var stripped sql.NullString
+		if report != nil {
+			reportData, err := json.Marshal(report)
+			if err != nil {
+				return err
+			}
+			stripped = sql.NullString{String: string(reportData), Valid: true}
+		}
+
+		hash := blob.Hash(data)
+		if err := Blobs.Put(ctx, hash, bytes.NewReader(data), int64(len(data))); err != nil {
+			return fmt.Errorf("failed to store image %d: %w", image.ID, err)
+		}
+		_, err = Database.Exec(`UPDATE images SET hash = ?, size = ?, mime = ?, width = ?, height = ?, stripped = ? WHERE id = ?`,
+			hash, len(data), info.Mime, info.Width, info.Height, stripped, image.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update image %d: %w", image.ID, err)
+		}
+		DeleteUnusedBlob(ctx, image.Hash)
+		normalized++
+	}
+	if normalized > 0 {
+		fmt.Printf("Decoded %d data URL images\n", normalized)
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+const (
+	SESSION_EXPIRATION  = 30 * 24 * time.Hour
+	REFRESH_TOKEN_BYTES = 32
+	SESSION_ID_BYTES    = 16
+)
+
+const (
+	createSessionsTableSQL = `CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT NOT NULL PRIMARY KEY,
+		wallet TEXT NOT NULL,
+		refresh_hash TEXT NOT NULL UNIQUE,
+		previous_hash TEXT,
+		user_agent TEXT,
+		ip TEXT,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		revoked BOOLEAN NOT NULL DEFAULT FALSE
+	);`
+
+	createSessionsIndexSQL = `CREATE INDEX IF NOT EXISTS sessions_wallet ON sessions (wallet);`
+
+	// Sessions group peers announced as revoked, their tokens are refused
+	// here until expires_at.
+	createPeerSessionRevocationsTableSQL = `CREATE TABLE IF NOT EXISTS peer_session_revocations (
+		node TEXT NOT NULL,
+		session TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		PRIMARY KEY (node, session)
+	);`
+)
+
+// Session is a login of a wallet. Key is the thumbprint of the key that
+// logged in, revoking the key ends the session.
+type Session struct {
+	ID         string    `json:"id"`
+	Wallet     string    `json:"wallet"`
+	Key        string    `json:"key"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Revoked    bool      `json:"revoked"`
+}
+
+func createSessionTables(database *sql.DB) error {
+	for _, query := range []string{
+		createSessionsTableSQL,
+		createSessionsIndexSQL,
+		createPeerSessionRevocationsTableSQL,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upgradeSessionsTable(database *sql.DB) error {
+	for _, column := range [][2]string{
+		{"key", "TEXT"},
+		{"revoked_at", "INTEGER"},
+	} {
+		if err := addColumnIfMissing(database, "sessions", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomBytes(size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateRefreshToken() (string, error) {
+	data, err := randomBytes(REFRESH_TOKEN_BYTES)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// CreateSession starts a new login session of the key and returns it together
+// with the refresh token. Only the hash of the refresh token is stored.
+func CreateSession(wallet string, key string, userAgent string, ip string) (Session, string, error) {
+	idBytes, err := randomBytes(SESSION_ID_BYTES)
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	refreshToken, err := generateRefreshToken()
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	now := time.Now()
+	session := Session{
+		ID:         hex.EncodeToString(idBytes),
+		Wallet:     wallet,
+		Key:        key,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  time.Unix(now.Unix(), 0),
+		LastUsedAt: time.Unix(now.Unix(), 0),
+		ExpiresAt:  time.Unix(now.Add(SESSION_EXPIRATION).Unix(), 0),
+	}
+
+	query := `INSERT INTO sessions (id, wallet, key, refresh_hash, user_agent, ip, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = Database.Exec(query, session.ID, wallet, key, hashToken(refreshToken), userAgent, ip,
+		session.CreatedAt.Unix(), session.LastUsedAt.Unix(), session.ExpiresAt.Unix())
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to store session: %w", err)
+	}
+
+	return session, refreshToken, nil
+}
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var session Session
+	var key, userAgent, ip sql.NullString
+	var createdAt, lastUsedAt, expiresAt int64
+	err := row.Scan(&session.ID, &session.Wallet, &key, &userAgent, &ip, &createdAt, &lastUsedAt, &expiresAt, &session.Revoked)
+	if err != nil {
+		return Session{}, err
+	}
+	session.Key = key.String
+	session.UserAgent = userAgent.String
+	session.IP = ip.String
+	session.CreatedAt = time.Unix(createdAt, 0)
+	session.LastUsedAt = time.Unix(lastUsedAt, 0)
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	return session, nil
+}
+
+const selectSessionColumns = `id, wallet, key, user_agent, ip, created_at, last_used_at, expires_at, revoked`
+
+// GetActiveSession returns the session if it belongs to the wallet and is
+// neither revoked nor expired.
+func GetActiveSession(id string, wallet string) (Session, error) {
+	query := `SELECT ` + selectSessionColumns + ` FROM sessions WHERE id = ? AND wallet = ?`
+	session, err := scanSession(Database.QueryRow(query, id, wallet))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Session{}, fmt.Errorf("session not found")
+		}
+		return Session{}, fmt.Errorf("failed to get session: %w", err)
+	}
+	if session.Revoked {
+		return Session{}, fmt.Errorf("session revoked")
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return Session{}, fmt.Errorf("session expired")
+	}
+	return session, nil
+}
+
+// RotateSession exchanges a refresh token for a new one. Presenting an
+// already rotated refresh token revokes the whole session, since it means
+// the token was copied.
+func RotateSession(refreshToken string) (Session, string, error) {
+	oldHash := hashToken(refreshToken)
+
+	query := `SELECT ` + selectSessionColumns + ` FROM sessions WHERE refresh_hash = ?`
+	session, err := scanSession(Database.QueryRow(query, oldHash))
+	if err == sql.ErrNoRows {
+		_, err = Database.Exec(`UPDATE sessions SET revoked = TRUE, revoked_at = ? WHERE previous_hash = ?`, time.Now().Unix(), oldHash)
+		if err != nil {
+			return Session{}, "", fmt.Errorf("failed to revoke session: %w", err)
+		}
+		return Session{}, "", fmt.Errorf("invalid refresh token")
+	}
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to get session: %w", err)
+	}
+	if session.Revoked || time.Now().After(session.ExpiresAt) {
+		return Session{}, "", fmt.Errorf("session expired")
+	}
+
+	newToken, err := generateRefreshToken()
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+
+	now := time.Now().Unix()
+	result, err := Database.Exec(`UPDATE sessions SET refresh_hash = ?, previous_hash = ?, last_used_at = ?
+		WHERE id = ? AND refresh_hash = ?`, hashToken(newToken), oldHash, now, session.ID, oldHash)
+	if err != nil {
+		return Session{}, "", fmt.Errorf("failed to rotate session: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return Session{}, "", fmt.Errorf("error checking affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return Session{}, "", fmt.Errorf("invalid refresh token")
+	}
+
+	session.LastUsedAt = time.Unix(now, 0)
+	return session, newToken, nil
+}
+
+func GetSessions(wallet string) ([]Session, error) {
+	query := `SELECT ` + selectSessionColumns + ` FROM sessions
+		WHERE wallet = ? AND revoked = FALSE AND expires_at > ? ORDER BY last_used_at DESC`
+	rows, err := Database.Query(query, wallet, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating session rows: %w", err)
+	}
+
+	return sessions, nil
+}
+
+func RevokeSession(wallet string, id string) error {
+	result, err := Database.Exec(`UPDATE sessions SET revoked = TRUE, revoked_at = ? WHERE wallet = ? AND id = ?`,
+		time.Now().Unix(), wallet, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error checking affected rows: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+func RevokeAllSessions(wallet string) error {
+	_, err := Database.Exec(`UPDATE sessions SET revoked = TRUE, revoked_at = ? WHERE wallet = ? AND revoked = FALSE`,
+		time.Now().Unix(), wallet)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// RevokeKeySessions ends every session the key logged in.
+func RevokeKeySessions(wallet string, key string) error {
+	_, err := Database.Exec(`UPDATE sessions SET revoked = TRUE, revoked_at = ? WHERE wallet = ? AND key = ? AND revoked = FALSE`,
+		time.Now().Unix(), wallet, key)
+	if err != nil {
+		return fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+	return nil
+}
+
+// GetRevokedSessionIDs returns the ids of the sessions revoked after since.
+func GetRevokedSessionIDs(since time.Time) ([]string, error) {
+	rows, err := Database.Query(`SELECT id FROM sessions WHERE revoked = TRUE AND revoked_at > ?`, since.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revoked sessions: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// AddPeerSessionRevocations records the sessions a group peer revoked.
+func AddPeerSessionRevocations(node string, sessions []string, expiresAt time.Time) error {
+	for _, session := range sessions {
+		_, err := Database.Exec(`INSERT OR REPLACE INTO peer_session_revocations (node, session, expires_at) VALUES (?, ?, ?)`,
+			node, session, expiresAt.Unix())
+		if err != nil {
+			return fmt.Errorf("failed to store session revocation: %w", err)
+		}
+	}
+	return nil
+}
+
+func IsPeerSessionRevoked(node string, session string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM peer_session_revocations WHERE node = ? AND session = ? AND expires_at > ?`
+	if err := Database.QueryRow(query, node, session, time.Now().Unix()).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check session revocation: %w", err)
+	}
+	return count > 0, nil
+}
+
+func DeleteExpiredSessions() (int64, error) {
+	now := time.Now().Unix()
+	result, err := Database.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired sessions: %w", err)
+	}
+	own, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = Database.Exec(`DELETE FROM peer_session_revocations WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired session revocations: %w", err)
+	}
+	peers, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return own + peers, nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	createSigningKeysTableSQL = `CREATE TABLE IF NOT EXISTS signing_keys (
+		kid TEXT NOT NULL PRIMARY KEY,
+		private_key BLOB NOT NULL,
+		created_at INTEGER NOT NULL,
+		retires_at INTEGER
+	);`
+
+	createPeerSigningKeysTableSQL = `CREATE TABLE IF NOT EXISTS peer_signing_keys (
+		kid TEXT NOT NULL PRIMARY KEY,
+		node TEXT NOT NULL,
+		key TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`
+)
+
+// SigningKey is a token signing key of this node. The active key has no
+// retirement time, rotated keys stay published until they retire.
+type SigningKey struct {
+	Kid        string
+	PrivateKey []byte
+	CreatedAt  time.Time
+	RetiresAt  *time.Time
+}
+
+type PeerSigningKey struct {
+	Kid       string
+	Node      string
+	Key       string
+	ExpiresAt time.Time
+}
+
+func createSigningKeyTables(database *sql.DB) error {
+	for _, query := range []string{
+		createSigningKeysTableSQL,
+		createPeerSigningKeysTableSQL,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanSigningKey(row interface{ Scan(...any) error }) (SigningKey, error) {
+	var key SigningKey
+	var createdAt int64
+	var retiresAt sql.NullInt64
+	if err := row.Scan(&key.Kid, &key.PrivateKey, &createdAt, &retiresAt); err != nil {
+		return SigningKey{}, err
+	}
+	key.CreatedAt = time.Unix(createdAt, 0)
+	if retiresAt.Valid {
+		retires := time.Unix(retiresAt.Int64, 0)
+		key.RetiresAt = &retires
+	}
+	return key, nil
+}
+
+// GetSigningKeys returns the active and the not yet retired signing keys,
+// newest first.
+func GetSigningKeys() ([]SigningKey, error) {
+	query := `SELECT kid, private_key, created_at, retires_at FROM signing_keys
+		WHERE retires_at IS NULL OR retires_at > ? ORDER BY created_at DESC`
+	rows, err := Database.Query(query, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signing keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []SigningKey
+	for rows.Next() {
+		key, err := scanSigningKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan signing key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating signing key rows: %w", err)
+	}
+
+	return keys, nil
+}
+
+// AddSigningKey stores a new active signing key and schedules the retirement
+// of the previously active ones.
+func AddSigningKey(kid string, privateKey []byte, retireOld time.Time) error {
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE signing_keys SET retires_at = ? WHERE retires_at IS NULL`, retireOld.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to retire signing keys: %w", err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO signing_keys (kid, private_key, created_at) VALUES (?, ?, ?)`,
+		kid, privateKey, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store signing key: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+func GetPeerSigningKey(kid string) (PeerSigningKey, error) {
+	query := `SELECT kid, node, key, expires_at FROM peer_signing_keys WHERE kid = ? AND expires_at > ?`
+
+	var key PeerSigningKey
+	var expiresAt int64
+	err := Database.QueryRow(query, kid, time.Now().Unix()).Scan(&key.Kid, &key.Node, &key.Key, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return PeerSigningKey{}, fmt.Errorf("unknown key id")
+		}
+		return PeerSigningKey{}, fmt.Errorf("failed to get peer signing key: %w", err)
+	}
+	key.ExpiresAt = time.Unix(expiresAt, 0)
+	return key, nil
+}
+
+// UpsertPeerSigningKey stores a key announced by a group peer. A key id
+// announced by another node is only taken over once it expired.
+func UpsertPeerSigningKey(key PeerSigningKey) error {
+	query := `INSERT INTO peer_signing_keys (kid, node, key, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (kid) DO UPDATE SET node = excluded.node, key = excluded.key, expires_at = excluded.expires_at
+		WHERE peer_signing_keys.node = excluded.node OR peer_signing_keys.expires_at <= ?`
+	_, err := Database.Exec(query, key.Kid, key.Node, key.Key, key.ExpiresAt.Unix(), time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store peer signing key: %w", err)
+	}
+	return nil
+}
+
+func DeleteExpiredSigningKeys() (int64, error) {
+	now := time.Now().Unix()
+	result, err := Database.Exec(`DELETE FROM signing_keys WHERE retires_at IS NOT NULL AND retires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete retired signing keys: %w", err)
+	}
+	own, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err = Database.Exec(`DELETE FROM peer_signing_keys WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired peer signing keys: %w", err)
+	}
+	peers, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return own + peers, nil
+}
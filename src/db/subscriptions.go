@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A subscription records a verified subscription of a wallet to an uploader,
+// it grants access to the private content of the uploader until expires_at.
+const createSubscriptionsTableSQL = `CREATE TABLE IF NOT EXISTS subscriptions (
+	subscriber TEXT NOT NULL,
+	uploader TEXT NOT NULL,
+	tx TEXT NOT NULL,
+	expires_at INTEGER NOT NULL,
+	verified_at INTEGER NOT NULL,
+	PRIMARY KEY (subscriber, uploader)
+);`
+
+type Subscription struct {
+	Subscriber string `json:"subscriber"`
+	Uploader   string `json:"uploader"`
+	Tx         string `json:"tx"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	VerifiedAt int64  `json:"verifiedAt"`
+}
+
+func createSubscriptionTables(database *sql.DB) error {
+	_, err := database.Exec(createSubscriptionsTableSQL)
+	return err
+}
+
+func HasActiveSubscription(subscriber string, uploader string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM subscriptions WHERE subscriber = ? AND uploader = ? AND expires_at > ?`
+	if err := Database.QueryRow(query, subscriber, uploader, time.Now().Unix()).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check subscription: %w", err)
+	}
+	return count > 0, nil
+}
+
+// PutSubscription records a verified subscription, replacing the earlier
+// state of the same subscription.
+func PutSubscription(subscription Subscription) error {
+	if subscription.VerifiedAt == 0 {
+		subscription.VerifiedAt = time.Now().Unix()
+	}
+	query := `INSERT OR REPLACE INTO subscriptions (subscriber, uploader, tx, expires_at, verified_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := Database.Exec(query, subscription.Subscriber, subscription.Uploader, subscription.Tx,
+		subscription.ExpiresAt, subscription.VerifiedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store subscription: %w", err)
+	}
+	return nil
+}
+
+// GetActiveSubscriptions lists the subscriptions of the wallet that haven't
+// expired, the one expiring first first.
+func GetActiveSubscriptions(subscriber string) ([]Subscription, error) {
+	query := `SELECT subscriber, uploader, tx, expires_at, verified_at FROM subscriptions
+		WHERE subscriber = ? AND expires_at > ? ORDER BY expires_at`
+	rows, err := Database.Query(query, subscriber, time.Now().Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		var subscription Subscription
+		err := rows.Scan(&subscription.Subscriber, &subscription.Uploader, &subscription.Tx,
+			&subscription.ExpiresAt, &subscription.VerifiedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription: %w", err)
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+func DeleteExpiredSubscriptions() (int64, error) {
+	result, err := Database.Exec(`DELETE FROM subscriptions WHERE expires_at <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired subscriptions: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	SWEEP_INTERVAL = time.Minute
+)
+
+// SweepExpired removes expired challenges, sessions, signing keys, upload
+// sessions, missing transactions and subscriptions periodically. It is meant
+// to run in its own goroutine for the lifetime of the server.
+func SweepExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := DeleteExpiredChallenges(); err != nil {
+			fmt.Println(err)
+		}
+		if _, err := DeleteExpiredSessions(); err != nil {
+			fmt.Println(err)
+		}
+		if _, err := DeleteExpiredSigningKeys(); err != nil {
+			fmt.Println(err)
+		}
+		if _, err := DeleteExpiredUploadSessions(); err != nil {
+			fmt.Println(err)
+		}
+		if _, err := DeleteExpiredMissingTxs(); err != nil {
+			fmt.Println(err)
+		}
+		if _, err := DeleteExpiredSubscriptions(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
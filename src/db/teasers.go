@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/acsermely/veracy.server/src/blob"
+	"github.com/acsermely/veracy.server/src/media"
+)
+
+var ErrNoTeaser = errors.New("image has no teaser")
+
+// ReadImageTeaser returns the blurred preview of the image, generating it if
+// the upload didn't get to it yet.
+func ReadImageTeaser(ctx context.Context, image Image) ([]byte, error) {
+	if !image.Teaser || image.Mime == "" {
+		return nil, ErrNoTeaser
+	}
+	if image.TeaserHash != "" {
+		data, err := blob.ReadAll(ctx, Blobs, image.TeaserHash)
+		if err != blob.ErrNotFound {
+			return data, err
+		}
+	}
+
+	data, _, err := createImageTeaser(ctx, image)
+	return data, err
+}
+
+func createImageTeaser(ctx context.Context, image Image) ([]byte, string, error) {
+	original, err := ReadImage(ctx, image)
+	if err != nil {
+		return nil, "", err
+	}
+	data, blurHash, err := media.Teaser(original)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := blob.Hash(data)
+	if err := Blobs.Put(ctx, hash, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, "", err
+	}
+	// The creator may have turned the teaser off in the meantime.
+	query := `UPDATE images SET teaser_hash = ?, blurhash = ? WHERE id = ? AND teaser = TRUE`
+	result, err := Database.Exec(query, hash, blurHash, image.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to store teaser: %w", err)
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		DeleteUnusedBlob(ctx, hash)
+		return nil, "", ErrNoTeaser
+	}
+
+	return data, blurHash, nil
+}
+
+// PrepareImageTeaser generates the teaser of a new upload, so it is ready
+// before the first unpaid viewer asks for it.
+func PrepareImageTeaser(image Image) {
+	if !image.Teaser || image.TeaserHash != "" {
+		return
+	}
+	if _, _, err := createImageTeaser(context.Background(), image); err != nil && err != ErrNoTeaser {
+		fmt.Println(err)
+	}
+}
+
+// SetImageTeaser turns the teaser of an image on or off. Turning it off
+// removes the stored preview and its BlurHash.
+func SetImageTeaser(wallet string, id int64, post string, enabled bool) (Image, error) {
+	image, err := GetImage(id, post, wallet)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if enabled {
+		_, err = Database.Exec(`UPDATE images SET teaser = TRUE WHERE id = ?`, id)
+	} else {
+		_, err = Database.Exec(`UPDATE images SET teaser = FALSE, teaser_hash = NULL, blurhash = NULL WHERE id = ?`, id)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to update teaser: %w", err)
+	}
+
+	if !enabled && image.TeaserHash != "" {
+		DeleteUnusedBlob(context.Background(), image.TeaserHash)
+	}
+
+	image.Teaser = enabled
+	if enabled {
+		go PrepareImageTeaser(image)
+	} else {
+		image.TeaserHash, image.BlurHash = "", ""
+	}
+	return image, nil
+}
+
+// DeleteUnusedBlob deletes the blob unless an image, teaser or variant still
+// refers to it.
+func DeleteUnusedBlob(ctx context.Context, hash string) {
+	used, err := isBlobUsed(hash)
+	if err != nil || used {
+		return
+	}
+	if err := Blobs.Delete(ctx, hash); err != nil {
+		fmt.Println(err)
+	}
+}
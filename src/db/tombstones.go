@@ -0,0 +1,142 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Tombstones outlive the deleted images, so peers keep refusing to serve
+// them. The token is the signed statement of the node that deleted the image.
+const createImageTombstonesTableSQL = `CREATE TABLE IF NOT EXISTS image_tombstones (
+	wallet TEXT NOT NULL,
+	post TEXT NOT NULL,
+	image_id INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	token TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (wallet, post, image_id)
+);`
+
+type ImageTombstone struct {
+	Wallet    string `json:"address"`
+	Post      string `json:"postId"`
+	ImageID   int64  `json:"id"`
+	Hash      string `json:"hash"`
+	Token     string `json:"token"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+func createImageTombstoneTables(database *sql.DB) error {
+	_, err := database.Exec(createImageTombstonesTableSQL)
+	return err
+}
+
+// IsImageDeleted tells whether a tombstone names the image. The hash is the
+// content of the image stored here, a tombstone of other content is about a
+// different image of a peer. Images not stored here are looked up without a
+// hash.
+func IsImageDeleted(id int64, post string, wallet string, hash string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM image_tombstones WHERE image_id = ? AND post = ? AND wallet = ? AND (? = '' OR hash = ?)`
+	if err := Database.QueryRow(query, id, post, wallet, hash, hash).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to check image tombstone: %w", err)
+	}
+	return count > 0, nil
+}
+
+// DeleteImage removes the image the tombstone names and records the
+// tombstone. Only a stored image with the same content is removed, the ids
+// of peers may name a different image here. Such a tombstone is dropped.
+func DeleteImage(tombstone ImageTombstone) error {
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var teaserHash sql.NullString
+	query := `SELECT teaser_hash FROM images WHERE id = ? AND post = ? AND wallet = ? AND hash = ?`
+	err = tx.QueryRow(query, tombstone.ImageID, tombstone.Post, tombstone.Wallet, tombstone.Hash).Scan(&teaserHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to get image: %w", err)
+	}
+	found := err == nil
+
+	if !found {
+		// A stored image of other content under the same id isn't the one
+		// the tombstone is about, the tombstone doesn't apply here.
+		var stored int
+		query = `SELECT COUNT(*) FROM images WHERE id = ? AND post = ? AND wallet = ?`
+		err = tx.QueryRow(query, tombstone.ImageID, tombstone.Post, tombstone.Wallet).Scan(&stored)
+		if err != nil {
+			return fmt.Errorf("failed to get image: %w", err)
+		}
+		if stored > 0 {
+			return nil
+		}
+	}
+
+	if found {
+		_, err = tx.Exec(`DELETE FROM images WHERE id = ?`, tombstone.ImageID)
+		if err != nil {
+			return fmt.Errorf("failed to delete image: %w", err)
+		}
+	}
+
+	if tombstone.CreatedAt == 0 {
+		tombstone.CreatedAt = time.Now().Unix()
+	}
+	_, err = tx.Exec(`INSERT OR IGNORE INTO image_tombstones (wallet, post, image_id, hash, token, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		tombstone.Wallet, tombstone.Post, tombstone.ImageID, tombstone.Hash, tombstone.Token, tombstone.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to store image tombstone: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if found {
+		deleteImageContent(context.Background(), tombstone.Hash, teaserHash.String)
+	}
+	return nil
+}
+
+// deleteImageContent removes the blobs of a deleted image that no other
+// image shares. Variants are kept per content, they go with the last image
+// of the content.
+func deleteImageContent(ctx context.Context, hash string, teaserHash string) {
+	if teaserHash != "" {
+		DeleteUnusedBlob(ctx, teaserHash)
+	}
+
+	var count int
+	if err := Database.QueryRow(`SELECT COUNT(*) FROM images WHERE hash = ?`, hash).Scan(&count); err != nil || count > 0 {
+		return
+	}
+
+	rows, err := Database.Query(`SELECT variant_hash FROM image_variants WHERE hash = ?`, hash)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	variantHashes := []string{}
+	for rows.Next() {
+		var variantHash string
+		if err := rows.Scan(&variantHash); err == nil {
+			variantHashes = append(variantHashes, variantHash)
+		}
+	}
+	rows.Close()
+
+	if _, err := Database.Exec(`DELETE FROM image_variants WHERE hash = ?`, hash); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, variantHash := range variantHashes {
+		DeleteUnusedBlob(ctx, variantHash)
+	}
+	DeleteUnusedBlob(ctx, hash)
+}
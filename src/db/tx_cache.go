@@ -0,0 +1,228 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/common"
+)
+
+// Arweave transactions never change, their posts are kept for good. Missing
+// transactions are remembered until expires_at only, they may still be on
+// their way to the gateways.
+const (
+	createTxCacheTableSQL = `CREATE TABLE IF NOT EXISTS tx_cache (
+		tx_id TEXT NOT NULL PRIMARY KEY,
+		post TEXT,
+		owner TEXT,
+		expires_at INTEGER,
+		created_at INTEGER NOT NULL
+	);`
+
+	// tx_content indexes the content of the cached posts by data id.
+	createTxContentTableSQL = `CREATE TABLE IF NOT EXISTS tx_content (
+		tx_id TEXT NOT NULL,
+		data_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		privacy TEXT NOT NULL,
+		PRIMARY KEY (tx_id, data_id)
+	);`
+
+	createTxContentIndexSQL = `CREATE INDEX IF NOT EXISTS tx_content_data ON tx_content (data_id);`
+)
+
+type TxCacheStats struct {
+	Posts   int64 `json:"posts"`
+	Missing int64 `json:"missing"`
+	Content int64 `json:"content"`
+}
+
+func createTxCacheTables(database *sql.DB) error {
+	for _, query := range []string{
+		createTxCacheTableSQL,
+		createTxContentTableSQL,
+		createTxContentIndexSQL,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeTxCacheTable adds the owner of the cached posts. Posts cached
+// before don't have it verified, the cache is dropped to read them again.
+func upgradeTxCacheTable(database *sql.DB) error {
+	exists, err := hasColumn(database, "tx_cache", "owner")
+	if err != nil || exists {
+		return err
+	}
+	for _, query := range []string{
+		`ALTER TABLE tx_cache ADD COLUMN owner TEXT;`,
+		`DELETE FROM tx_cache;`,
+		`DELETE FROM tx_content;`,
+	} {
+		if _, err := database.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TxCache stores the posts read from Arweave for the arweave client.
+type TxCache struct{}
+
+// GetPost returns the cached post of the transaction. A nil post that is
+// not missing wasn't looked up yet.
+func (TxCache) GetPost(txId string) (*common.Post, bool, error) {
+	var data sql.NullString
+	var expiresAt sql.NullInt64
+	query := `SELECT post, expires_at FROM tx_cache WHERE tx_id = ?`
+	err := Database.QueryRow(query, txId).Scan(&data, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get cached transaction: %w", err)
+	}
+
+	if !data.Valid {
+		return nil, expiresAt.Valid && expiresAt.Int64 > time.Now().Unix(), nil
+	}
+	var post common.Post
+	if err := json.Unmarshal([]byte(data.String), &post); err != nil {
+		return nil, false, fmt.Errorf("failed to parse cached transaction: %w", err)
+	}
+	post.ID = txId
+	return &post, false, nil
+}
+
+// GetContent returns the indexed content of a cached post of the owner.
+func (TxCache) GetContent(txId string, owner string, dataId string) (*common.PostContent, error) {
+	content := common.PostContent{Data: dataId}
+	query := `SELECT c.type, c.privacy FROM tx_content c JOIN tx_cache t ON t.tx_id = c.tx_id
+		WHERE c.tx_id = ? AND c.data_id = ? AND t.owner = ?`
+	err := Database.QueryRow(query, txId, dataId, owner).Scan(&content.Type, &content.Privacy)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cached content: %w", err)
+	}
+	return &content, nil
+}
+
+func (TxCache) PutPost(post *common.Post) error {
+	data, err := json.Marshal(post)
+	if err != nil {
+		return err
+	}
+
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT OR REPLACE INTO tx_cache (tx_id, post, owner, expires_at, created_at) VALUES (?, ?, ?, NULL, ?)`
+	if _, err := tx.Exec(query, post.ID, string(data), post.Owner, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to cache transaction: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tx_content WHERE tx_id = ?`, post.ID); err != nil {
+		return fmt.Errorf("failed to index transaction: %w", err)
+	}
+	for _, content := range post.Content {
+		if content.Data == "" {
+			continue
+		}
+		_, err := tx.Exec(`INSERT OR REPLACE INTO tx_content (tx_id, data_id, type, privacy) VALUES (?, ?, ?, ?)`,
+			post.ID, content.Data, content.Type, content.Privacy)
+		if err != nil {
+			return fmt.Errorf("failed to index transaction: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// PutMissing remembers for a while that the transaction wasn't found.
+func (TxCache) PutMissing(txId string, ttl time.Duration) error {
+	now := time.Now()
+	query := `INSERT INTO tx_cache (tx_id, post, expires_at, created_at) VALUES (?, NULL, ?, ?)
+		ON CONFLICT (tx_id) DO UPDATE SET expires_at = excluded.expires_at WHERE post IS NULL`
+	if _, err := Database.Exec(query, txId, now.Add(ttl).Unix(), now.Unix()); err != nil {
+		return fmt.Errorf("failed to cache missing transaction: %w", err)
+	}
+	return nil
+}
+
+// InvalidateTx drops a transaction from the cache, it is read again on the
+// next lookup.
+func InvalidateTx(txId string) (int64, error) {
+	tx, err := Database.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM tx_cache WHERE tx_id = ?`, txId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to invalidate transaction: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tx_content WHERE tx_id = ?`, txId); err != nil {
+		return 0, fmt.Errorf("failed to invalidate transaction: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// InvalidateTxData drops every cached transaction referring to the data id.
+func InvalidateTxData(dataId string) (int64, error) {
+	rows, err := Database.Query(`SELECT tx_id FROM tx_content WHERE data_id = ?`, dataId)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query cached content: %w", err)
+	}
+	txIds := []string{}
+	for rows.Next() {
+		var txId string
+		if err := rows.Scan(&txId); err == nil {
+			txIds = append(txIds, txId)
+		}
+	}
+	rows.Close()
+
+	var invalidated int64
+	for _, txId := range txIds {
+		count, err := InvalidateTx(txId)
+		if err != nil {
+			return invalidated, err
+		}
+		invalidated += count
+	}
+	return invalidated, nil
+}
+
+func GetTxCacheStats() (TxCacheStats, error) {
+	var stats TxCacheStats
+	query := `SELECT
+		(SELECT COUNT(*) FROM tx_cache WHERE post IS NOT NULL),
+		(SELECT COUNT(*) FROM tx_cache WHERE post IS NULL AND expires_at > ?),
+		(SELECT COUNT(*) FROM tx_content)`
+	err := Database.QueryRow(query, time.Now().Unix()).Scan(&stats.Posts, &stats.Missing, &stats.Content)
+	if err != nil {
+		return TxCacheStats{}, fmt.Errorf("failed to get transaction cache stats: %w", err)
+	}
+	return stats, nil
+}
+
+func DeleteExpiredMissingTxs() (int64, error) {
+	result, err := Database.Exec(`DELETE FROM tx_cache WHERE post IS NULL AND expires_at <= ?`, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired missing transactions: %w", err)
+	}
+	return result.RowsAffected()
+}
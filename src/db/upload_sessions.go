@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	UPLOAD_SESSION_EXPIRATION = 24 * time.Hour
+	UPLOAD_SESSION_ID_BYTES   = 16
+)
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadOffsetMismatch  = errors.New("upload offset mismatch")
+)
+
+// The content of a session is collected in the file at path, until it is
+// complete and stored like a single request upload.
+const createUploadSessionsTableSQL = `CREATE TABLE IF NOT EXISTS upload_sessions (
+	id TEXT NOT NULL PRIMARY KEY,
+	wallet TEXT NOT NULL,
+	post TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	teaser BOOLEAN NOT NULL,
+	received INTEGER NOT NULL DEFAULT 0,
+	path TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);`
+
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Wallet    string    `json:"wallet"`
+	Post      string    `json:"postId"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"`
+	Teaser    bool      `json:"teaser"`
+	Offset    int64     `json:"offset"`
+	Path      string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func createUploadSessionTables(database *sql.DB) error {
+	_, err := database.Exec(createUploadSessionsTableSQL)
+	return err
+}
+
+const selectUploadSessionColumns = `id, wallet, post, size, hash, teaser, received, path, created_at, expires_at`
+
+func scanUploadSession(row interface{ Scan(...any) error }) (UploadSession, error) {
+	var session UploadSession
+	var createdAt, expiresAt int64
+	err := row.Scan(&session.ID, &session.Wallet, &session.Post, &session.Size, &session.Hash,
+		&session.Teaser, &session.Offset, &session.Path, &createdAt, &expiresAt)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session.CreatedAt = time.Unix(createdAt, 0)
+	session.ExpiresAt = time.Unix(expiresAt, 0)
+	return session, nil
+}
+
+// CreateUploadSession opens a resumable upload with an empty file in dir
+// for its content.
+func CreateUploadSession(session UploadSession, dir string) (UploadSession, error) {
+	idBytes, err := randomBytes(UPLOAD_SESSION_ID_BYTES)
+	if err != nil {
+		return UploadSession{}, fmt.Errorf("failed to generate upload session id: %w", err)
+	}
+	session.ID = hex.EncodeToString(idBytes)
+	session.Offset = 0
+	session.Path = filepath.Join(dir, session.ID)
+	now := time.Unix(time.Now().Unix(), 0)
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(UPLOAD_SESSION_EXPIRATION)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return UploadSession{}, err
+	}
+	file, err := os.OpenFile(session.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	file.Close()
+
+	query := `INSERT INTO upload_sessions (` + selectUploadSessionColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = Database.Exec(query, session.ID, session.Wallet, session.Post, session.Size, session.Hash,
+		session.Teaser, session.Offset, session.Path, session.CreatedAt.Unix(), session.ExpiresAt.Unix())
+	if err != nil {
+		os.Remove(session.Path)
+		return UploadSession{}, fmt.Errorf("failed to store upload session: %w", err)
+	}
+	return session, nil
+}
+
+// GetUploadSession returns an unexpired upload session of the wallet.
+func GetUploadSession(id string, wallet string) (UploadSession, error) {
+	query := `SELECT ` + selectUploadSessionColumns + ` FROM upload_sessions WHERE id = ? AND wallet = ? AND expires_at > ?`
+	session, err := scanUploadSession(Database.QueryRow(query, id, wallet, time.Now().Unix()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return UploadSession{}, ErrUploadSessionNotFound
+		}
+		return UploadSession{}, fmt.Errorf("failed to get upload session: %w", err)
+	}
+	return session, nil
+}
+
+func CountUploadSessions(wallet string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM upload_sessions WHERE wallet = ? AND expires_at > ?`
+	if err := Database.QueryRow(query, wallet, time.Now().Unix()).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count upload sessions: %w", err)
+	}
+	return count, nil
+}
+
+// AdvanceUploadSession records content received from the offset on and
+// extends the expiry of the session. It fails if the offset moved in the
+// meantime.
+func AdvanceUploadSession(session UploadSession, from int64, to int64) (UploadSession, error) {
+	expiresAt := time.Unix(time.Now().Unix(), 0).Add(UPLOAD_SESSION_EXPIRATION)
+	query := `UPDATE upload_sessions SET received = ?, expires_at = ? WHERE id = ? AND wallet = ? AND received = ?`
+	result, err := Database.Exec(query, to, expiresAt.Unix(), session.ID, session.Wallet, from)
+	if err != nil {
+		return UploadSession{}, fmt.Errorf("failed to update upload session: %w", err)
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		return UploadSession{}, ErrUploadOffsetMismatch
+	}
+	session.Offset = to
+	session.ExpiresAt = expiresAt
+	return session, nil
+}
+
+// DeleteUploadSession removes the session of the wallet together with its
+// content.
+func DeleteUploadSession(id string, wallet string) error {
+	session, err := GetUploadSession(id, wallet)
+	if err != nil {
+		return err
+	}
+	if _, err := Database.Exec(`DELETE FROM upload_sessions WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+	os.Remove(session.Path)
+	return nil
+}
+
+// DeleteExpiredUploadSessions removes the incomplete uploads that were not
+// continued in time.
+func DeleteExpiredUploadSessions() (int64, error) {
+	now := time.Now().Unix()
+	rows, err := Database.Query(`SELECT path FROM upload_sessions WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query expired upload sessions: %w", err)
+	}
+	paths := []string{}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	rows.Close()
+
+	result, err := Database.Exec(`DELETE FROM upload_sessions WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired upload sessions: %w", err)
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A key revocation keeps the signed statement that revoked a key, local and
+// peer wallets alike, so a bundle sent before the revocation can't bring the
+// key back.
+const createKeyRevocationsTableSQL = `CREATE TABLE IF NOT EXISTS key_revocations (
+	wallet TEXT NOT NULL,
+	key TEXT NOT NULL,
+	proof TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	PRIMARY KEY (wallet, key)
+);`
+
+// KeyRevocation names the revoked key by its thumbprint.
+type KeyRevocation struct {
+	Wallet    string
+	Key       string
+	Proof     string
+	CreatedAt int64
+}
+
+const selectUserKeyColumns = `id, wallet, key, COALESCE(name, ''), COALESCE(created_at, 0), COALESCE(proof, ''), cached`
+
+func upgradeKeysTable(database *sql.DB) error {
+	for _, column := range [][2]string{
+		{"name", "TEXT"},
+		{"created_at", "INTEGER"},
+		{"proof", "TEXT"},
+		{"revoked", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"cached", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	} {
+		if err := addColumnIfMissing(database, "keys", column[0], column[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func createKeyRevocationTables(database *sql.DB) error {
+	_, err := database.Exec(createKeyRevocationsTableSQL)
+	return err
+}
+
+func scanUserKey(row interface{ Scan(...any) error }) (UserKey, error) {
+	var key UserKey
+	err := row.Scan(&key.ID, &key.WalletID, &key.Key, &key.Name, &key.CreatedAt, &key.Proof, &key.Cached)
+	return key, err
+}
+
+// GetUserKeys returns the active keys of the wallet, oldest first.
+func GetUserKeys(wallet string) ([]UserKey, error) {
+	query := `SELECT ` + selectUserKeyColumns + ` FROM keys WHERE wallet = ? AND revoked = FALSE ORDER BY id`
+	rows, err := Database.Query(query, wallet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []UserKey{}
+	for rows.Next() {
+		key, err := scanUserKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating key rows: %w", err)
+	}
+
+	return keys, nil
+}
+
+func GetUserKeyByID(wallet string, id int) (UserKey, error) {
+	query := `SELECT ` + selectUserKeyColumns + ` FROM keys WHERE wallet = ? AND id = ? AND revoked = FALSE`
+	key, err := scanUserKey(Database.QueryRow(query, wallet, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return UserKey{}, fmt.Errorf("key not found")
+		}
+		return UserKey{}, fmt.Errorf("failed to get key: %w", err)
+	}
+	return key, nil
+}
+
+// AddUserKey stores an additional key of the wallet. The proof is the signed
+// statement that authorized it, so peers can verify the key as well.
+func AddUserKey(wallet string, key string, name string, proof string) error {
+	query := `INSERT INTO keys (wallet, key, name, proof, created_at) VALUES (?, ?, ?, ?, ?)`
+	_, err := Database.Exec(query, wallet, key, name, proof, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to add key: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserKey revokes the key and records the signed revocation, keyed by
+// the thumbprint of the key.
+func RevokeUserKey(wallet string, id int, thumbprint string, proof string) error {
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE keys SET revoked = TRUE WHERE wallet = ? AND id = ?`, wallet, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke key: %w", err)
+	}
+	if err := expectAffected(result, "key not found"); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO key_revocations (wallet, key, proof, created_at) VALUES (?, ?, ?, ?)`,
+		wallet, thumbprint, proof, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record revocation: %w", err)
+	}
+	return tx.Commit()
+}
+
+// AddKeyRevocation records a revocation received from a peer.
+func AddKeyRevocation(wallet string, thumbprint string, proof string) error {
+	_, err := Database.Exec(`INSERT OR IGNORE INTO key_revocations (wallet, key, proof, created_at) VALUES (?, ?, ?, ?)`,
+		wallet, thumbprint, proof, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record revocation: %w", err)
+	}
+	return nil
+}
+
+func GetKeyRevocations(wallet string) ([]KeyRevocation, error) {
+	rows, err := Database.Query(`SELECT wallet, key, proof, created_at FROM key_revocations WHERE wallet = ? ORDER BY created_at`, wallet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revocations: %w", err)
+	}
+	defer rows.Close()
+
+	revocations := []KeyRevocation{}
+	for rows.Next() {
+		var revocation KeyRevocation
+		if err := rows.Scan(&revocation.Wallet, &revocation.Key, &revocation.Proof, &revocation.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan revocation: %w", err)
+		}
+		revocations = append(revocations, revocation)
+	}
+	return revocations, rows.Err()
+}
+
+// ReplaceCachedKeys stores the keys of a wallet fetched from a group peer.
+// Wallets registered on this node are never overwritten.
+func ReplaceCachedKeys(wallet string, keys []UserKey) error {
+	tx, err := Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var local int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM keys WHERE wallet = ? AND cached = FALSE`, wallet).Scan(&local)
+	if err != nil {
+		return fmt.Errorf("failed to check keys: %w", err)
+	}
+	if local > 0 {
+		return fmt.Errorf("wallet %s is registered on this node", wallet)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM keys WHERE wallet = ? AND cached = TRUE`, wallet); err != nil {
+		return fmt.Errorf("failed to delete cached keys: %w", err)
+	}
+	now := time.Now().Unix()
+	for _, key := range keys {
+		_, err := tx.Exec(`INSERT INTO keys (wallet, key, name, proof, created_at, cached) VALUES (?, ?, ?, ?, ?, TRUE)`,
+			wallet, key.Key, key.Name, key.Proof, now)
+		if err != nil {
+			return fmt.Errorf("failed to cache key: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteCachedKeys drops the keys cached from peers, so they are fetched
+// again on the next use.
+func DeleteCachedKeys(wallet string) error {
+	_, err := Database.Exec(`DELETE FROM keys WHERE wallet = ? AND cached = TRUE`, wallet)
+	if err != nil {
+		return fmt.Errorf("failed to delete cached keys: %w", err)
+	}
+	return nil
+}
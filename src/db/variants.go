@@ -0,0 +1,116 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/acsermely/veracy.server/src/blob"
+	"github.com/acsermely/veracy.server/src/media"
+)
+
+// Variants are kept per original content hash, so images deduplicated in
+// the blob store share their variants as well.
+const createImageVariantsTableSQL = `CREATE TABLE IF NOT EXISTS image_variants (
+	hash TEXT NOT NULL,
+	width INTEGER NOT NULL,
+	variant_hash TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	mime TEXT NOT NULL,
+	height INTEGER NOT NULL,
+	PRIMARY KEY (hash, width)
+);`
+
+func createImageVariantTables(database *sql.DB) error {
+	_, err := database.Exec(createImageVariantsTableSQL)
+	return err
+}
+
+func imageInfo(image Image) media.Info {
+	return media.Info{Mime: image.Mime, Width: image.Width, Height: image.Height}
+}
+
+// ImageContent is a stored image or one of its variants, with the hash of
+// the content.
+type ImageContent struct {
+	Data []byte
+	Mime string
+	Hash string
+}
+
+// ImageVariantHash returns the hash of the content ReadImageVariant would
+// return, without reading it. It is empty if the variant wasn't generated
+// yet.
+func ImageVariantHash(image Image, width int) string {
+	if !media.CanResize(imageInfo(image), width) {
+		return image.Hash
+	}
+	var variantHash string
+	query := `SELECT variant_hash FROM image_variants WHERE hash = ? AND width = ?`
+	if err := Database.QueryRow(query, image.Hash, width).Scan(&variantHash); err != nil {
+		return ""
+	}
+	return variantHash
+}
+
+// ReadImageVariant returns the image scaled to the width. Variants are
+// generated on first request, the original is returned when it is already
+// narrow enough or can't be resized.
+func ReadImageVariant(ctx context.Context, image Image, width int) (ImageContent, error) {
+	if !media.CanResize(imageInfo(image), width) {
+		data, err := ReadImage(ctx, image)
+		return ImageContent{Data: data, Mime: image.Mime, Hash: image.Hash}, err
+	}
+
+	var variantHash, mime string
+	query := `SELECT variant_hash, mime FROM image_variants WHERE hash = ? AND width = ?`
+	err := Database.QueryRow(query, image.Hash, width).Scan(&variantHash, &mime)
+	if err == nil {
+		data, err := blob.ReadAll(ctx, Blobs, variantHash)
+		if err != blob.ErrNotFound {
+			return ImageContent{Data: data, Mime: mime, Hash: variantHash}, err
+		}
+	} else if err != sql.ErrNoRows {
+		return ImageContent{}, fmt.Errorf("failed to get image variant: %w", err)
+	}
+
+	return createImageVariant(ctx, image, width)
+}
+
+func createImageVariant(ctx context.Context, image Image, width int) (ImageContent, error) {
+	original, err := ReadImage(ctx, image)
+	if err != nil {
+		return ImageContent{}, err
+	}
+	data, info, err := media.Resize(original, width)
+	if err != nil {
+		return ImageContent{}, err
+	}
+
+	hash := blob.Hash(data)
+	if err := Blobs.Put(ctx, hash, bytes.NewReader(data), int64(len(data))); err != nil {
+		return ImageContent{}, err
+	}
+	query := `INSERT OR REPLACE INTO image_variants (hash, width, variant_hash, size, mime, height) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = Database.Exec(query, image.Hash, width, hash, len(data), info.Mime, info.Height)
+	if err != nil {
+		return ImageContent{}, fmt.Errorf("failed to store image variant: %w", err)
+	}
+
+	return ImageContent{Data: data, Mime: info.Mime, Hash: hash}, nil
+}
+
+// PrepareImageVariants generates the variants of the presets used by the
+// feed, so the first viewers don't wait for them.
+func PrepareImageVariants(image Image) {
+	for _, preset := range []string{media.PRESET_THUMB, media.PRESET_FEED} {
+		width, _ := media.ParseWidth(preset)
+		if !media.CanResize(imageInfo(image), width) {
+			continue
+		}
+		if _, err := ReadImageVariant(context.Background(), image, width); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"github.com/acsermely/veracy.server/src/common"
 	"github.com/acsermely/veracy.server/src/config"
 	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/media"
 	"github.com/acsermely/veracy.server/src/proto/github.com/acsermely/veracy.server/distributed/pb"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/core/protocol"
 	"google.golang.org/protobuf/proto"
 )
@@ -29,6 +31,13 @@ var (
 	arriveChans ChannelMap
 	arriveMutex sync.Mutex
 
+	needRequests chan needRequest
+
+	// Wallets nobody in the group knew are not asked for again for a while,
+	// so unknown addresses can't be used to flood the group.
+	missingUsers      = make(map[string]time.Time)
+	missingUsersMutex sync.Mutex
+
 	// Dynamic Topics
 	GroupBroadcastTopic string
 )
@@ -38,6 +47,17 @@ const (
 	IMAGE_TRANSFER_PROTOCOL      protocol.ID = "/permit-image-transfer/0.0.1"
 	KEY_TRANSFER_PROTOCOL        protocol.ID = "/veracy-key-transfer/0.0.1"
 	NETWORK_TIMEOUT                          = 5 * time.Second
+	MISSING_USER_TTL                         = time.Minute
+	VARIANT_SEPARATOR                        = "@"
+	TEASER_VARIANT                           = "teaser"
+)
+
+// Requests for content are answered by NEED_CONTENT_WORKERS at once, so a
+// slow resize doesn't hold up the others. Requests beyond the queue are
+// dropped, the peer asks the group again.
+const (
+	NEED_CONTENT_WORKERS = 4
+	NEED_CONTENT_QUEUE   = 64
 )
 
 func Connect(conf *config.AppConfig) *ContentNode {
@@ -61,6 +81,10 @@ func Connect(conf *config.AppConfig) *ContentNode {
 		println("Subscription error for NEED_BROADCAST", err)
 	}
 	Node.h.SetStreamHandler(IMAGE_TRANSFER_PROTOCOL, imageTransferHandler)
+	needRequests = make(chan needRequest, NEED_CONTENT_QUEUE)
+	for i := 0; i < NEED_CONTENT_WORKERS; i++ {
+		go answerNeedContent()
+	}
 	go listenToNeedContentTopic(needSub)
 
 	// Group protocol
@@ -86,13 +110,31 @@ func Connect(conf *config.AppConfig) *ContentNode {
 		fmt.Printf("Warning: failed to initialize inbox protocol: %v\n", err)
 	}
 
+	if err := initSigningKeys(); err != nil {
+		fmt.Printf("Warning: failed to initialize signing key exchange: %v\n", err)
+	}
+
+	if err := initKeyChanges(); err != nil {
+		fmt.Printf("Warning: failed to initialize key change protocol: %v\n", err)
+	}
+
+	if err := initTombstones(); err != nil {
+		fmt.Printf("Warning: failed to initialize tombstone protocol: %v\n", err)
+	}
+
 	return Node
 }
 
-func NeedById(id string) ([]byte, error) {
+// NeedById asks the peers for an image, or for a variant of it unless the
+// variant is empty. The variant is appended to the id of the request, older
+// peers don't answer requests for variants.
+func NeedById(id string, variant string) ([]byte, error) {
 	if len(id) == 0 {
 		return nil, fmt.Errorf("invalid id")
 	}
+	if variant != "" {
+		id = id + VARIANT_SEPARATOR + variant
+	}
 
 	arriveMutex.Lock()
 	if _, exists := arriveChans[id]; !exists {
@@ -117,11 +159,27 @@ func NeedById(id string) ([]byte, error) {
 	}
 }
 
+func parseNeedId(id string) (string, string) {
+	imageId, variant, _ := strings.Cut(id, VARIANT_SEPARATOR)
+	return imageId, variant
+}
+
 func GroupUserByAddress(address string) ([]byte, error) {
 	if len(address) == 0 {
 		return nil, fmt.Errorf("invalid id")
 	}
 
+	missingUsersMutex.Lock()
+	missingSince, missing := missingUsers[address]
+	if missing && time.Since(missingSince) > MISSING_USER_TTL {
+		delete(missingUsers, address)
+		missing = false
+	}
+	missingUsersMutex.Unlock()
+	if missing {
+		return nil, fmt.Errorf("unknown user")
+	}
+
 	arriveMutex.Lock()
 	if _, exists := arriveChans[address]; !exists {
 		arriveChans[address] = []chan []byte{}
@@ -141,6 +199,15 @@ func GroupUserByAddress(address string) ([]byte, error) {
 		arriveMutex.Lock()
 		delete(arriveChans, address)
 		arriveMutex.Unlock()
+
+		missingUsersMutex.Lock()
+		for wallet, since := range missingUsers {
+			if time.Since(since) > MISSING_USER_TTL {
+				delete(missingUsers, wallet)
+			}
+		}
+		missingUsers[address] = time.Now()
+		missingUsersMutex.Unlock()
 		return nil, fmt.Errorf("timeout")
 	}
 }
@@ -194,6 +261,11 @@ func groupKeyTransferHandler(s network.Stream) {
 	transferData := &pb.KeyTransferData{}
 	if err := proto.Unmarshal(data, transferData); err != nil {
 		fmt.Println("Error while Unmarshal", err)
+		return
+	}
+	if _, err := VerifyKeyBundle(transferData.Id, []byte(transferData.Key)); err != nil {
+		fmt.Println("Rejected key from peer:", err)
+		return
 	}
 	if chans, exists := arriveChans[transferData.Id]; exists {
 		for _, ch := range chans {
@@ -203,6 +275,29 @@ func groupKeyTransferHandler(s network.Stream) {
 	}
 }
 
+// needRequest is a request of a peer for an image this node stores.
+type needRequest struct {
+	from    peer.ID
+	id      string
+	image   db.Image
+	variant string
+}
+
+// readImageVariant reads the variant a peer asked for. Widths are rounded
+// up to the variant widths like the ones of the Image endpoint, so peers
+// can't have a variant stored for every width.
+func readImageVariant(image db.Image, variant string) ([]byte, error) {
+	if variant == TEASER_VARIANT {
+		return db.ReadImageTeaser(ctx, image)
+	}
+	width, err := media.ParseWidth(variant)
+	if err != nil {
+		return nil, fmt.Errorf("invalid variant %q", variant)
+	}
+	content, err := db.ReadImageVariant(ctx, image, width)
+	return content.Data, err
+}
+
 func listenToNeedContentTopic(sub *pubsub.Subscription) {
 	for {
 		m, err := sub.Next(ctx)
@@ -217,20 +312,46 @@ func listenToNeedContentTopic(sub *pubsub.Subscription) {
 		if len(id) < 1 {
 			continue
 		}
-		parts := strings.Split(id, ":")
+		imageId, variant := parseNeedId(id)
+		parts := strings.Split(imageId, ":")
+		if len(parts) != 3 {
+			continue
+		}
 		wallet, post, idStr := parts[0], parts[1], parts[2]
 		idInt, err := strconv.Atoi(idStr)
 		if err != nil {
 			continue
 		}
-		var imageData []byte
-		err = db.Database.QueryRow("SELECT data FROM images WHERE id = ? AND post = ? AND wallet = ?", idInt, post, wallet).Scan(&imageData)
+		image, err := db.GetImage(int64(idInt), post, wallet)
+		if err != nil {
+			continue
+		}
+		// Deleted images are refused even if a copy is left somewhere.
+		if deleted, err := db.IsImageDeleted(image.ID, post, wallet, image.Hash); err != nil || deleted {
+			continue
+		}
+
+		select {
+		case needRequests <- needRequest{from: m.ReceivedFrom, id: id, image: image, variant: variant}:
+		default:
+		}
+	}
+}
+
+// answerNeedContent reads the requested images and sends them to the peers
+// that asked.
+func answerNeedContent() {
+	for request := range needRequests {
+		imageData, err := readImageVariant(request.image, request.variant)
 		if err != nil {
+			if err != db.ErrNoTeaser {
+				fmt.Println(err)
+			}
 			continue
 		}
 
 		transferData := &pb.ImageTransferData{
-			Id:   id,
+			Id:   request.id,
 			Data: imageData,
 		}
 
@@ -241,7 +362,7 @@ func listenToNeedContentTopic(sub *pubsub.Subscription) {
 			continue
 		}
 
-		s, err := Node.h.NewStream(ctx, m.ReceivedFrom, IMAGE_TRANSFER_PROTOCOL)
+		s, err := Node.h.NewStream(ctx, request.from, IMAGE_TRANSFER_PROTOCOL)
 		if err != nil {
 			continue
 		}
@@ -270,15 +391,24 @@ func listenToGroupKeyTopic(sub *pubsub.Subscription) {
 			continue
 		}
 
-		var userKey string
-		err = db.Database.QueryRow("SELECT key FROM keys WHERE wallet = ?", wallet).Scan(&userKey)
+		userKeys, err := db.GetUserKeys(wallet)
+		if err != nil || len(userKeys) == 0 {
+			continue
+		}
+		revocations, err := db.GetKeyRevocations(wallet)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		bundle, err := keyBundle(userKeys, revocations)
 		if err != nil {
+			fmt.Println("Key bundle error:", err)
 			continue
 		}
 
 		transferData := &pb.KeyTransferData{
 			Id:  wallet,
-			Key: userKey,
+			Key: string(bundle),
 		}
 
 		data, err := proto.Marshal(transferData)
@@ -0,0 +1,115 @@
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/keyring"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const KEY_CHANGES_TOPIC_SUFFIX = "/key-changes"
+
+func keyChangesTopic() string {
+	return GroupBroadcastTopic + KEY_CHANGES_TOPIC_SUFFIX
+}
+
+// keyBundle serializes the keys of a wallet together with the proofs that
+// authorized them and the revocations of its earlier keys, for the
+// KEY_TRANSFER_PROTOCOL.
+func keyBundle(userKeys []db.UserKey, revocations []db.KeyRevocation) ([]byte, error) {
+	bundle := keyring.Bundle{}
+	for _, userKey := range userKeys {
+		entry := keyring.Entry{Key: userKey.Key, Name: userKey.Name}
+		if userKey.Proof != "" {
+			var proof keyring.Proof
+			if err := json.Unmarshal([]byte(userKey.Proof), &proof); err != nil {
+				return nil, err
+			}
+			entry.Proof = &proof
+		}
+		bundle.Keys = append(bundle.Keys, entry)
+	}
+	for _, revocation := range revocations {
+		var proof keyring.Proof
+		if err := json.Unmarshal([]byte(revocation.Proof), &proof); err != nil {
+			return nil, err
+		}
+		bundle.Revoked = append(bundle.Revoked, keyring.Revocation{Key: revocation.Key, Proof: proof})
+	}
+	return json.Marshal(bundle)
+}
+
+// VerifyKeyBundle verifies the keys of a wallet received from a peer against
+// the revocations seen so far, and records the new revocations it carries.
+func VerifyKeyBundle(wallet string, data []byte) (keyring.Bundle, error) {
+	revocations, err := db.GetKeyRevocations(wallet)
+	if err != nil {
+		return keyring.Bundle{}, err
+	}
+	revoked := make([]string, 0, len(revocations))
+	for _, revocation := range revocations {
+		revoked = append(revoked, revocation.Key)
+	}
+
+	bundle, err := keyring.VerifyBundle(wallet, data, revoked)
+	if err != nil {
+		return keyring.Bundle{}, err
+	}
+	for _, revocation := range bundle.Revoked {
+		proof, err := json.Marshal(revocation.Proof)
+		if err != nil {
+			return keyring.Bundle{}, err
+		}
+		if err := db.AddKeyRevocation(wallet, revocation.Key, string(proof)); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return bundle, nil
+}
+
+func initKeyChanges() error {
+	topic, err := Node.Join(keyChangesTopic())
+	if err != nil {
+		return fmt.Errorf("failed to join key changes topic: %w", err)
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to key changes topic: %w", err)
+	}
+
+	go listenToKeyChangesTopic(sub)
+
+	return nil
+}
+
+// PublishKeyChange tells the group that the keys of the wallet changed, so
+// peers drop their cached copy and fetch the keys again when needed.
+func PublishKeyChange(wallet string) error {
+	topic, ok := Node.Topics[keyChangesTopic()]
+	if !ok {
+		return fmt.Errorf("key changes topic not initialized")
+	}
+	return topic.Publish(ctx, []byte(wallet))
+}
+
+func listenToKeyChangesTopic(sub *pubsub.Subscription) {
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+			continue
+		}
+		if m.GetFrom() == Node.PeerID() {
+			continue
+		}
+		wallet := string(m.Data)
+		if len(wallet) < 1 {
+			continue
+		}
+		if err := db.DeleteCachedKeys(wallet); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
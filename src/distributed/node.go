@@ -76,7 +76,7 @@ func (node *ContentNode) PeerID() peer.ID {
 }
 
 func printNewPeerInfo(h host.Host) {
-	fmt.Sprintln("Start new peers:")
+	fmt.Println("Start new peers:")
 	for _, ownAddress := range h.Addrs() {
 		fmt.Printf("go run . -b %v/p2p/%v -p 8081\n", ownAddress, h.ID())
 	}
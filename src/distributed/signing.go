@@ -0,0 +1,85 @@
+package distributed
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/signing"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	SIGNING_KEYS_TOPIC_SUFFIX      = "/signing-keys"
+	SIGNING_KEY_BROADCAST_INTERVAL = time.Minute
+)
+
+func signingKeysTopic() string {
+	return GroupBroadcastTopic + SIGNING_KEYS_TOPIC_SUFFIX
+}
+
+func initSigningKeys() error {
+	signing.Issuer = Node.ID()
+
+	topic, err := Node.Join(signingKeysTopic())
+	if err != nil {
+		return fmt.Errorf("failed to join signing keys topic: %w", err)
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to signing keys topic: %w", err)
+	}
+
+	go listenToSigningKeysTopic(sub)
+	go broadcastSigningKeys()
+
+	return nil
+}
+
+// PublishSigningKeys announces the token signing keys of this node to the
+// group, so peers accept the tokens it issues.
+func PublishSigningKeys() error {
+	topic, ok := Node.Topics[signingKeysTopic()]
+	if !ok {
+		return fmt.Errorf("signing keys topic not initialized")
+	}
+
+	data, err := signing.Announce()
+	if err != nil {
+		return fmt.Errorf("failed to build signing key announcement: %w", err)
+	}
+
+	return topic.Publish(ctx, data)
+}
+
+func broadcastSigningKeys() {
+	ticker := time.NewTicker(SIGNING_KEY_BROADCAST_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if err := signing.RotateIfDue(); err != nil {
+			fmt.Printf("Error rotating signing key: %v\n", err)
+		}
+		if err := PublishSigningKeys(); err != nil {
+			fmt.Printf("Error publishing signing keys: %v\n", err)
+		}
+		<-ticker.C
+	}
+}
+
+func listenToSigningKeysTopic(sub *pubsub.Subscription) {
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+			continue
+		}
+		// GetFrom is the signed author of the message, not the relaying peer.
+		from := m.GetFrom()
+		if from == Node.PeerID() {
+			continue
+		}
+		if err := signing.ReceiveAnnouncement(from.String(), m.Data); err != nil {
+			fmt.Printf("Rejected signing keys from %v: %v\n", from, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package distributed
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/keyring"
+	"github.com/acsermely/veracy.server/src/signing"
+	"github.com/golang-jwt/jwt/v4"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+const (
+	TOMBSTONES_TOPIC_SUFFIX = "/image-tombstones"
+	TOMBSTONE_AUDIENCE      = "veracy-tombstone"
+)
+
+func tombstonesTopic() string {
+	return GroupBroadcastTopic + TOMBSTONES_TOPIC_SUFFIX
+}
+
+func initTombstones() error {
+	topic, err := Node.Join(tombstonesTopic())
+	if err != nil {
+		return fmt.Errorf("failed to join tombstones topic: %w", err)
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to tombstones topic: %w", err)
+	}
+
+	go listenToTombstonesTopic(sub)
+
+	return nil
+}
+
+// SignImageTombstone builds the tombstone of a deleted image, signed with
+// the token signing key of this node. It carries the delete statement the
+// owner of the wallet signed, so group peers can verify both.
+func SignImageTombstone(image db.Image, proof keyring.Proof) (db.ImageTombstone, error) {
+	proofData, err := json.Marshal(proof)
+	if err != nil {
+		return db.ImageTombstone{}, err
+	}
+
+	now := time.Now()
+	token, err := signing.Sign(jwt.MapClaims{
+		"aud":   TOMBSTONE_AUDIENCE,
+		"user":  image.Wallet,
+		"post":  image.Post,
+		"image": image.ID,
+		"hash":  image.Hash,
+		"proof": string(proofData),
+		"iat":   now.Unix(),
+	})
+	if err != nil {
+		return db.ImageTombstone{}, err
+	}
+
+	return db.ImageTombstone{
+		Wallet:    image.Wallet,
+		Post:      image.Post,
+		ImageID:   image.ID,
+		Hash:      image.Hash,
+		Token:     token,
+		CreatedAt: now.Unix(),
+	}, nil
+}
+
+// PublishImageTombstone tells the group that an image was deleted, so peers
+// purge their copy and stop serving it.
+func PublishImageTombstone(tombstone db.ImageTombstone) error {
+	topic, ok := Node.Topics[tombstonesTopic()]
+	if !ok {
+		return fmt.Errorf("tombstones topic not initialized")
+	}
+	return topic.Publish(ctx, []byte(tombstone.Token))
+}
+
+// walletKeys returns the active keys of the wallet, fetched from the group
+// if this node doesn't know the wallet.
+func walletKeys(wallet string) ([]string, error) {
+	userKeys, err := db.GetUserKeys(wallet)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, userKey := range userKeys {
+		keys = append(keys, userKey.Key)
+	}
+	if len(keys) > 0 {
+		return keys, nil
+	}
+
+	keyData, err := GroupUserByAddress(wallet)
+	if err != nil {
+		return nil, err
+	}
+	bundle, err := VerifyKeyBundle(wallet, keyData)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range bundle.Keys {
+		keys = append(keys, entry.Key)
+	}
+	return keys, nil
+}
+
+// verifyDeleteProof checks that the owner of the wallet signed the delete of
+// the image, with the wallet key or one of its active device keys.
+func verifyDeleteProof(tombstone db.ImageTombstone, proofData string) error {
+	var proof keyring.Proof
+	if err := json.Unmarshal([]byte(proofData), &proof); err != nil {
+		return fmt.Errorf("missing delete proof")
+	}
+	signer, err := proof.Verify()
+	if err != nil {
+		return err
+	}
+
+	fields, err := keyring.ParseStatement(keyring.IMAGE_DELETE_DOMAIN, proof.Message)
+	if err != nil {
+		return err
+	}
+	if fields["Wallet"] != tombstone.Wallet || fields["Post"] != tombstone.Post ||
+		fields["Image"] != strconv.FormatInt(tombstone.ImageID, 10) || fields["Hash"] != tombstone.Hash {
+		return fmt.Errorf("delete proof does not match tombstone")
+	}
+
+	if arweave.VerifyKeyOwner(tombstone.Wallet, proof.SignerKey) == nil {
+		return nil
+	}
+	keys, err := walletKeys(tombstone.Wallet)
+	if err != nil {
+		return fmt.Errorf("failed to get keys of %s: %w", tombstone.Wallet, err)
+	}
+	for _, key := range keys {
+		if thumbprint, err := keyring.Thumbprint(key); err == nil && thumbprint == signer {
+			return nil
+		}
+	}
+	return fmt.Errorf("signer is not a key of the wallet")
+}
+
+// parseImageTombstone verifies a tombstone token. It has to be signed by
+// the node that sent it and carry the delete statement of the wallet owner,
+// a node can't delete the images of wallets it doesn't hold the keys of.
+func parseImageTombstone(from string, tokenString string) (db.ImageTombstone, error) {
+	token, _, err := signing.Parse(tokenString)
+	if err != nil {
+		return db.ImageTombstone{}, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyAudience(TOMBSTONE_AUDIENCE, true) || !claims.VerifyIssuer(from, true) {
+		return db.ImageTombstone{}, fmt.Errorf("invalid tombstone")
+	}
+
+	wallet, _ := claims["user"].(string)
+	post, _ := claims["post"].(string)
+	hash, _ := claims["hash"].(string)
+	id, _ := claims["image"].(float64)
+	createdAt, _ := claims["iat"].(float64)
+	proof, _ := claims["proof"].(string)
+	if wallet == "" || post == "" || hash == "" || id <= 0 {
+		return db.ImageTombstone{}, fmt.Errorf("incomplete tombstone")
+	}
+
+	tombstone := db.ImageTombstone{
+		Wallet:    wallet,
+		Post:      post,
+		ImageID:   int64(id),
+		Hash:      hash,
+		Token:     tokenString,
+		CreatedAt: int64(createdAt),
+	}
+	if err := verifyDeleteProof(tombstone, proof); err != nil {
+		return db.ImageTombstone{}, err
+	}
+	return tombstone, nil
+}
+
+func listenToTombstonesTopic(sub *pubsub.Subscription) {
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+			continue
+		}
+		from := m.GetFrom()
+		if from == Node.PeerID() {
+			continue
+		}
+		tombstone, err := parseImageTombstone(from.String(), string(m.Data))
+		if err != nil {
+			fmt.Printf("Rejected tombstone from %v: %v\n", from, err)
+			continue
+		}
+		if err := db.DeleteImage(tombstone); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
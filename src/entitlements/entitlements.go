@@ -0,0 +1,108 @@
+package entitlements
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/db"
+)
+
+// Report sums up a re-verification. Entitlements whose payment couldn't be
+// checked count as failed, they are kept.
+type Report struct {
+	Checked int      `json:"checked"`
+	Revoked []string `json:"revoked"`
+	Failed  []string `json:"failed"`
+}
+
+// Status is the state of the re-verification job.
+type Status struct {
+	Running    bool    `json:"running"`
+	StartedAt  int64   `json:"startedAt,omitempty"`
+	FinishedAt int64   `json:"finishedAt,omitempty"`
+	Report     *Report `json:"report,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+var (
+	status      Status
+	statusMutex sync.Mutex
+)
+
+func entitlementName(entitlement db.Entitlement) string {
+	return fmt.Sprintf("%s:%s:%s", entitlement.Buyer, entitlement.Uploader, entitlement.Post)
+}
+
+// Reverify checks every entitlement against the chain again and revokes the
+// ones the payment of doesn't hold up anymore.
+func Reverify(ctx context.Context, client *arweave.Client) (Report, error) {
+	entitlements, err := db.GetAllEntitlements()
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Revoked: []string{}, Failed: []string{}}
+	for _, entitlement := range entitlements {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		report.Checked++
+
+		payment, err := client.CheckPayment(ctx, entitlement.Buyer, entitlement.PostTx, entitlement.Uploader, entitlement.Post)
+		if err != nil {
+			fmt.Printf("Failed to verify entitlement %s: %v\n", entitlementName(entitlement), err)
+			report.Failed = append(report.Failed, entitlementName(entitlement))
+			continue
+		}
+		if payment.Paid {
+			entitlement.PaymentTx = payment.Tx
+			entitlement.Amount = payment.Amount
+			entitlement.VerifiedAt = time.Now().Unix()
+			if err := db.AddEntitlement(entitlement); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		if err := db.DeleteEntitlement(entitlement.Buyer, entitlement.Uploader, entitlement.Post); err != nil {
+			fmt.Println(err)
+			report.Failed = append(report.Failed, entitlementName(entitlement))
+			continue
+		}
+		report.Revoked = append(report.Revoked, entitlementName(entitlement))
+	}
+	return report, nil
+}
+
+// Start runs a re-verification in the background. It returns false if one
+// is running already.
+func Start(client *arweave.Client) bool {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	if status.Running {
+		return false
+	}
+	status = Status{Running: true, StartedAt: time.Now().Unix()}
+
+	go func() {
+		report, err := Reverify(context.Background(), client)
+
+		statusMutex.Lock()
+		defer statusMutex.Unlock()
+		status.Running = false
+		status.FinishedAt = time.Now().Unix()
+		status.Report = &report
+		if err != nil {
+			status.Error = err.Error()
+		}
+	}()
+	return true
+}
+
+func GetStatus() Status {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	return status
+}
@@ -4,25 +4,46 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/distributed"
+	"github.com/acsermely/veracy.server/src/entitlements"
+	"github.com/acsermely/veracy.server/src/orphans"
+	"github.com/acsermely/veracy.server/src/signing"
 	"github.com/golang-jwt/jwt/v4"
 )
 
+func adminChallengeWallet(name string) string {
+	return ADMIN_CHALLENGE_WALLET + ":" + name
+}
+
+func adminName(name string) string {
+	if name == "" {
+		return db.DEFAULT_ADMIN_NAME
+	}
+	return name
+}
+
 func GetAdminChal(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 
-	adminKeyString := os.Getenv("ADMIN_KEY")
+	name := adminName(r.URL.Query().Get("name"))
+	admin, err := db.GetAdmin(name)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	rsaPublicKey, err := parsePublicKeyString(adminKeyString)
+	rsaPublicKey, err := parsePublicKeyString(admin.Key)
 	if err != nil {
 		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
 		return
 	}
 
-	challange, err := db.SetAdminChal()
+	challange, err := db.CreateChallenge(adminChallengeWallet(name), db.CHALLENGE_PURPOSE_ADMIN_LOGIN)
 	if err != nil {
 		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
 		return
@@ -41,8 +62,6 @@ func GetAdminChal(w http.ResponseWriter, r *http.Request) {
 func LoginAdminChal(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 
-	secret := []byte(os.Getenv("SECRET"))
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -54,59 +73,349 @@ func LoginAdminChal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	adminChal, err := db.GetAdminChal()
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+	if loginCreds.Chal == "" {
+		http.Error(w, "Invalid Challange", http.StatusUnauthorized)
 		return
 	}
 
-	if adminChal == "" || loginCreds.Chal != adminChal {
+	name := adminName(loginCreds.Name)
+	_, err := db.ConsumeChallenge(adminChallengeWallet(name), db.CHALLENGE_PURPOSE_ADMIN_LOGIN, loginCreds.Chal)
+	if err != nil {
 		http.Error(w, "Invalid Challange", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	admin, err := db.GetAdmin(name)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tokenString, err := createAdminToken(admin)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(tokenString))
+}
+
+func createAdminToken(admin db.Admin) (string, error) {
+	return signing.Sign(jwt.MapClaims{
 		"authorized": true,
-		"user":       "admin",
+		"user":       admin.Name,
+		"role":       admin.Role,
+		"aud":        ADMIN_TOKEN_AUDIENCE,
 		"exp":        time.Now().Add(JWT_COOKIE_EXPIRATION).Unix(),
 	})
+}
 
-	tokenString, err := token.SignedString(secret)
+// parseAdminToken validates an admin bearer token and returns the admin it
+// was issued for, as currently stored, so removed or demoted admins lose
+// their access immediately.
+func parseAdminToken(r *http.Request) (db.Admin, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return db.Admin{}, fmt.Errorf("missing token")
+	}
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
+	// Admins are managed per node, so only tokens of this node are accepted.
+	token, local, err := signing.Parse(tokenString)
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return db.Admin{}, err
+	}
+	if !local {
+		return db.Admin{}, fmt.Errorf("admin token issued by another node")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyAudience(ADMIN_TOKEN_AUDIENCE, true) {
+		return db.Admin{}, fmt.Errorf("invalid token")
+	}
+	name, ok := claims["user"].(string)
+	if !ok || name == "" {
+		return db.Admin{}, fmt.Errorf("invalid token user")
+	}
+	role, ok := claims["role"].(string)
+	if !ok || !db.IsValidAdminRole(role) {
+		return db.Admin{}, fmt.Errorf("invalid token role")
+	}
+
+	admin, err := db.GetAdmin(name)
+	if err != nil {
+		return db.Admin{}, err
+	}
+	// A demoted admin still holds a token with the old role until it
+	// expires, so the stored role caps the claimed one.
+	if db.AdminRoleAllows(role, admin.Role) {
+		role = admin.Role
+	}
+	admin.Role = role
+	return admin, nil
+}
+
+func ListAdmins(w http.ResponseWriter, r *http.Request) {
+	admins, err := db.GetAdmins()
+	if err != nil {
+		http.Error(w, "Failed to get admins", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admins)
+}
 
-	_ = db.ResetAdminChal()
+func AddAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details AdminBody
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil || details.Name == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !db.IsValidAdminRole(details.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if _, err := parsePublicKeyString(details.Key); err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.GetAdmin(details.Name); err == nil {
+		http.Error(w, "Admin already exists", http.StatusConflict)
+		return
+	}
+
+	if err := db.AddAdmin(details.Name, details.Role, details.Key); err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to add admin", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func SetAdminRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details AdminBody
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil || details.Name == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !db.IsValidAdminRole(details.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	admin, err := db.GetAdmin(details.Name)
+	if err != nil {
+		http.Error(w, "Admin not found", http.StatusNotFound)
+		return
+	}
+	if admin.Role == db.ADMIN_ROLE_SUPERADMIN && details.Role != db.ADMIN_ROLE_SUPERADMIN && isLastSuperadmin() {
+		http.Error(w, "Cannot demote the last superadmin", http.StatusConflict)
+		return
+	}
+
+	if err := db.SetAdminRole(details.Name, details.Role); err != nil {
+		http.Error(w, "Failed to set role", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func RemoveAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var details AdminBody
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil || details.Name == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	admin, err := db.GetAdmin(details.Name)
+	if err != nil {
+		http.Error(w, "Admin not found", http.StatusNotFound)
+		return
+	}
+	if admin.Role == db.ADMIN_ROLE_SUPERADMIN && isLastSuperadmin() {
+		http.Error(w, "Cannot remove the last superadmin", http.StatusConflict)
+		return
+	}
+
+	if err := db.RemoveAdmin(details.Name); err != nil {
+		http.Error(w, "Failed to remove admin", http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(tokenString))
 }
 
+func RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := signing.Rotate(); err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to rotate signing key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := distributed.PublishSigningKeys(); err != nil {
+		fmt.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func isLastSuperadmin() bool {
+	count, err := db.CountAdmins(db.ADMIN_ROLE_SUPERADMIN)
+	return err != nil || count <= 1
+}
+
+// GetAllImages lists the metadata of every image, the content is served by
+// GetImageContent.
 func GetAllImages(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Database.Query("SELECT id, wallet, post, data, active FROM images")
+	images, err := db.GetAllImages()
 	if err != nil {
 		fmt.Println(err)
+		http.Error(w, "Failed to get images", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-	var imageDataList []ImageData
-	for rows.Next() {
-		var imageData ImageData
-		err := rows.Scan(&imageData.Id, &imageData.Wallet, &imageData.Post, &imageData.Data, &imageData.Active)
-		if err != nil {
-			fmt.Println(err)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+// GetOrphanImages is the dry run of the orphan reconciler, it lists the
+// uploads it would remove. The grace period can be overridden with grace=.
+func GetOrphanImages(w http.ResponseWriter, r *http.Request) {
+	grace := OrphanGrace
+	if value := r.URL.Query().Get("grace"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid grace period", http.StatusBadRequest)
 			return
 		}
-		imageDataList = append(imageDataList, imageData)
+		grace = parsed
 	}
-	if err = rows.Err(); err != nil {
+
+	report, err := orphans.Find(r.Context(), Arweave, grace)
+	if err != nil {
 		fmt.Println(err)
+		http.Error(w, "Failed to find orphaned images", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(imageDataList)
+	json.NewEncoder(w).Encode(report)
+}
+
+// GetTxCache shows how well the transaction cache answers the lookups.
+func GetTxCache(w http.ResponseWriter, r *http.Request) {
+	stored, err := db.GetTxCacheStats()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to get cache stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TxCacheResponse{
+		Lookups: Arweave.CacheStats(),
+		Stored:  stored,
+	})
+}
+
+// InvalidateTxCache drops a transaction, or every transaction referring to a
+// data id, from the cache.
+func InvalidateTxCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body InvalidateTxBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || (body.Tx == "") == (body.DataID == "") {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	var invalidated int64
+	var err error
+	if body.Tx != "" {
+		invalidated, err = db.InvalidateTx(body.Tx)
+	} else {
+		invalidated, err = db.InvalidateTxData(body.DataID)
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to invalidate cache", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InvalidateTxResponse{Invalidated: invalidated})
+}
+
+// ReverifyEntitlements checks the recorded purchases against the chain
+// again. POST starts the job in the background, GET shows its state.
+func ReverifyEntitlements(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !entitlements.Start(Arweave) {
+			http.Error(w, "Re-verification is running", http.StatusConflict)
+			return
+		}
+		status = http.StatusAccepted
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(entitlements.GetStatus())
+}
+
+// GetImageContent serves a stored image regardless of its privacy and
+// activity, for moderation.
+func GetImageContent(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id, err := strconv.Atoi(query.Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+
+	image, err := db.GetImage(int64(id), query.Get("postId"), query.Get("address"))
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	data, err := db.ReadImage(r.Context(), image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+		return
+	}
+	if image.Mime != "" {
+		w.Header().Set("Content-Type", image.Mime)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	w.Write(data)
 }
 
 func SetImageActivity(w http.ResponseWriter, r *http.Request) {
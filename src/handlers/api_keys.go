@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/acsermely/veracy.server/src/db"
+)
+
+// apiKeyFromRequest returns the API key of the request, it is sent as a
+// bearer token and is told apart from access tokens by its prefix.
+func apiKeyFromRequest(r *http.Request) (string, bool) {
+	secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return secret, strings.HasPrefix(secret, db.API_KEY_PREFIX)
+}
+
+func CreateApiKey(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body CreateApiKeyBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if body.Name == "" || len(body.Name) > API_KEY_NAME_MAX_LENGTH {
+		http.Error(w, "Invalid name", http.StatusBadRequest)
+		return
+	}
+	if len(body.Scopes) == 0 {
+		http.Error(w, "Missing scopes", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range body.Scopes {
+		if !db.IsValidApiScope(scope) {
+			http.Error(w, "Invalid scope "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	apiKey, secret, err := db.CreateApiKey(storedUser.WalletID, body.Name, body.Scopes)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateApiKeyResponse{
+		ApiKey: apiKey,
+		Secret: secret,
+	})
+}
+
+func ListApiKeys(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	apiKeys, err := db.GetApiKeys(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys)
+}
+
+func RevokeApiKey(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body RevokeApiKeyBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == 0 {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.RevokeApiKey(storedUser.WalletID, body.ID); err != nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,23 +1,25 @@
 package handlers
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/blob"
 	"github.com/acsermely/veracy.server/src/db"
 	"github.com/acsermely/veracy.server/src/distributed"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/acsermely/veracy.server/src/keyring"
+	"github.com/acsermely/veracy.server/src/media"
+	"github.com/acsermely/veracy.server/src/signing"
 )
 
 func Register(w http.ResponseWriter, r *http.Request) {
@@ -40,18 +42,35 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := arweave.VerifyKeyOwner(user.WalletID, user.Key); err != nil {
+		http.Error(w, "Key does not match Wallet", http.StatusForbidden)
+		return
+	}
+
 	_, err = db.GetUserKey(user.WalletID)
 	if err == nil {
 		http.Error(w, "Wallet already registered", http.StatusConflict)
 		return
 	}
 
-	challange, err := db.InsertUserKey(user.WalletID, user.Key)
+	thumbprint, err := keyring.Thumbprint(user.Key)
+	if err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
+		return
+	}
+
+	err = db.InsertUserKey(user.WalletID, user.Key)
 	if err != nil {
 		http.Error(w, "Couldn't register user", http.StatusInternalServerError)
 		return
 	}
 
+	challange, err := db.CreateKeyChallenge(user.WalletID, db.CHALLENGE_PURPOSE_LOGIN, thumbprint)
+	if err != nil {
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
+	}
+
 	encryptedText, err := encryptWithPublicKey(rsaPublicKey, challange)
 	if err != nil {
 		http.Error(w, "Failed to create Challange", http.StatusInternalServerError)
@@ -73,16 +92,42 @@ func encryptWithPublicKey(rsaPublicKey *rsa.PublicKey, plaintext string) ([]byte
 }
 
 func parsePublicKeyString(key string) (*rsa.PublicKey, error) {
-	publicJWK, err := jwk.ParseKey([]byte(key))
+	return keyring.ParsePublicKey(key)
+}
+
+// loadUserKey returns the oldest stored key of the wallet. Unknown wallets
+// are looked up in the group and their keys are cached locally.
+func loadUserKey(walletId string) (db.UserKey, error) {
+	user, err := db.GetUserKey(walletId)
+	if err == nil {
+		return user, nil
+	}
+
+	keyData, err := distributed.GroupUserByAddress(walletId)
 	if err != nil {
-		return nil, err
+		return db.UserKey{}, err
+	}
+	bundle, err := distributed.VerifyKeyBundle(walletId, keyData)
+	if err != nil {
+		return db.UserKey{}, err
 	}
 
-	var rsaPublicKey rsa.PublicKey
-	if err := publicJWK.Raw(&rsaPublicKey); err != nil {
-		return nil, err
+	userKeys := make([]db.UserKey, 0, len(bundle.Keys))
+	for _, entry := range bundle.Keys {
+		userKey := db.UserKey{WalletID: walletId, Key: entry.Key, Name: entry.Name}
+		if entry.Proof != nil {
+			proof, err := json.Marshal(entry.Proof)
+			if err != nil {
+				return db.UserKey{}, err
+			}
+			userKey.Proof = string(proof)
+		}
+		userKeys = append(userKeys, userKey)
+	}
+	if err := db.ReplaceCachedKeys(walletId, userKeys); err != nil {
+		return db.UserKey{}, err
 	}
-	return &rsaPublicKey, nil
+	return db.GetUserKey(walletId)
 }
 
 func GetLoginChal(w http.ResponseWriter, r *http.Request) {
@@ -94,39 +139,43 @@ func GetLoginChal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var key string
-	var challange string
-	user, err := db.GetUserKey(walletId)
+	user, err := loadUserKey(walletId)
 	if err != nil {
-		keyData, err := distributed.GroupUserByAddress(walletId)
+		fmt.Println(err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if keyIdStr := r.URL.Query().Get("keyId"); keyIdStr != "" {
+		keyId, err := strconv.Atoi(keyIdStr)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			http.Error(w, "Invalid Key ID", http.StatusBadRequest)
 			return
 		}
-		key = string(keyData)
-		challange, err = db.InsertUserKey(walletId, key)
+		user, err = db.GetUserKeyByID(walletId, keyId)
 		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			http.Error(w, "Key not found", http.StatusNotFound)
 			return
 		}
 	}
 
-	if key == "" {
-		key = user.Key
+	rsaPublicKey, err := parsePublicKeyString(user.Key)
+	if err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
+		return
 	}
-
-	rsaPublicKey, err := parsePublicKeyString(key)
+	thumbprint, err := keyring.Thumbprint(user.Key)
 	if err != nil {
 		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
 		return
 	}
 
-	if challange == "" {
-		challange, err = db.SetNewChal(walletId)
-		if err != nil {
-			http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
-			return
-		}
+	// The session started with the challenge is bound to the key it was
+	// encrypted for.
+	challange, err := db.CreateKeyChallenge(walletId, db.CHALLENGE_PURPOSE_LOGIN, thumbprint)
+	if err != nil {
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
 	}
 
 	encryptedText, err := encryptWithPublicKey(rsaPublicKey, challange)
@@ -142,8 +191,6 @@ func GetLoginChal(w http.ResponseWriter, r *http.Request) {
 func LoginWhitChal(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 
-	secret := []byte(os.Getenv("SECRET"))
-
 	if r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -155,34 +202,24 @@ func LoginWhitChal(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	storedKey, err := db.GetUserKey(loginCreds.WalletID)
+	_, err := db.GetUserKey(loginCreds.WalletID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if storedKey.Chal == "" || loginCreds.Chal != storedKey.Chal {
+	if loginCreds.Chal == "" {
 		http.Error(w, "Invalid Challange", http.StatusUnauthorized)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"authorized": true,
-		"user":       loginCreds.WalletID,
-		"exp":        time.Now().Add(JWT_COOKIE_EXPIRATION).Unix(),
-	})
-
-	tokenString, err := token.SignedString(secret)
-
+	chal, err := db.ConsumeChallenge(loginCreds.WalletID, db.CHALLENGE_PURPOSE_LOGIN, loginCreds.Chal)
 	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		http.Error(w, "Invalid Challange", http.StatusUnauthorized)
 		return
 	}
 
-	_ = db.DeleteChal(loginCreds.WalletID)
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(tokenString))
+	startSession(w, r, loginCreds.WalletID, chal.Subject)
 }
 
 func LoginCheckKey(w http.ResponseWriter, r *http.Request) {
@@ -191,37 +228,9 @@ func LoginCheckKey(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(storedUser.WalletID))
 }
 
-func Upload(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	postId := r.FormValue("id")
-
-	walletId := r.FormValue("walletId")
-
-	imageData := r.FormValue("image")
-
-	result, err := db.Database.Exec(`INSERT INTO images (wallet, post, data) VALUES (?, ?, ?)`, walletId, postId, []byte(imageData))
-	if err != nil {
-		http.Error(w, "Failed to store image", http.StatusInternalServerError)
-		return
-	}
-
-	id, err := result.LastInsertId()
-	if err != nil {
-		http.Error(w, "Failed to retrieve image ID", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, "%d", id)
-}
-
 func Image(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, Range")
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 		return
@@ -235,6 +244,10 @@ func Image(w http.ResponseWriter, r *http.Request) {
 	tx := r.URL.Query().Get("tx")
 
 	parts := strings.Split(fullId, ":")
+	if len(parts) != 3 {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
 	wallet, post, idStr := parts[0], parts[1], parts[2]
 
 	id, err := strconv.Atoi(idStr)
@@ -243,80 +256,286 @@ func Image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isPrivate, err := arweave.IsDataPrivate(fullId, tx)
+	width, err := media.ParseWidth(r.URL.Query().Get("w"))
+	if err != nil {
+		http.Error(w, "Invalid width", http.StatusBadRequest)
+		return
+	}
+
+	// The hash of a stored image is compared with the tombstones, images not
+	// stored here are refused on any tombstone of their id.
+	image, imageErr := db.GetImage(int64(id), post, wallet)
+	deleted, err := db.IsImageDeleted(int64(id), post, wallet, image.Hash)
+	if err != nil {
+		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+		return
+	}
+	if deleted {
+		http.Error(w, "Deleted image", http.StatusGone)
+		return
+	}
+
+	isPrivate, err := Arweave.IsDataPrivate(r.Context(), fullId, tx)
+	if errors.Is(err, arweave.ErrNotIndexed) {
+		http.Error(w, "Post not indexed yet", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Data check failed", http.StatusBadRequest)
 		return
 	}
+
+	if imageErr == nil && !image.Active {
+		http.Error(w, "Disabled image", http.StatusForbidden)
+		return
+	}
+	// The tag of a stored image is known without reading it, so clients with
+	// a fresh copy are answered before anything expensive happens.
+	etag := ""
+	if imageErr == nil {
+		etag = contentETag(db.ImageVariantHash(image, width))
+	}
+
+	if !isPrivate && etagMatches(r, etag) {
+		writeNotModified(w, etag, isPrivate)
+		return
+	}
+
 	if isPrivate {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header missing", http.StatusUnauthorized)
+		// Anonymous viewers get the teaser like the ones who didn't pay. A
+		// token that doesn't parse is still refused with 401, so clients
+		// know to refresh it.
+		if r.Header.Get("Authorization") == "" {
+			writeTeaser(w, r, fullId, int64(id), post, wallet, arweave.PAYMENT_LOGIN_REQUIRED)
 			return
 		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		secret := []byte(os.Getenv("SECRET"))
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return secret, nil
-		})
+		userWallet, _, err := parseUserToken(r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized"))
 			return
 		}
 
-		var userWallet string
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			userWallet = claims["user"].(string)
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized"))
-			return
-		}
-
-		storedUser, err := db.GetUserKey(userWallet)
+		storedUser, err := loadUserKey(userWallet)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusUnauthorized)
 			return
 		}
 
 		if storedUser.WalletID != wallet {
-			paid, err := arweave.CheckPayment(storedUser.WalletID, tx, wallet, post)
+			payment, err := checkEntitlement(r, storedUser.WalletID, tx, wallet, post)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusServiceUnavailable)
 				return
 			}
-			if !paid {
-				http.Error(w, "Couldn't find payment", http.StatusPaymentRequired)
+			if !payment.Paid {
+				writeTeaser(w, r, fullId, int64(id), post, wallet, payment.Reason)
 				return
 			}
 		}
+
+		// Only the owner and the entitled viewers get here.
+		if etagMatches(r, etag) {
+			writeNotModified(w, etag, isPrivate)
+			return
+		}
 	}
 
-	var imageData []byte
-	var imageActive bool
-	err = db.Database.QueryRow("SELECT data, active FROM images WHERE id = ? AND post = ? AND wallet = ?", id, post, wallet).Scan(&imageData, &imageActive)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			imageData, err = distributed.NeedById(fullId)
-			if err != nil {
-				http.Error(w, "Image not found", http.StatusNotFound)
-				return
-			}
-		} else {
+	var content db.ImageContent
+	if imageErr == db.ErrImageNotFound {
+		content.Data, err = needImage(fullId, width)
+		if err != nil {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		// Peers only send the content, the type is sniffed again.
+		content.Mime, _ = media.Sniff(content.Data)
+		content.Hash = blob.Hash(content.Data)
+	} else if imageErr != nil {
+		http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
+		return
+	} else {
+		content, err = db.ReadImageVariant(r.Context(), image, width)
+		if err != nil {
+			fmt.Println(err)
 			http.Error(w, "Failed to fetch image", http.StatusInternalServerError)
 			return
 		}
-	} else if !imageActive {
-		http.Error(w, "Disabled image", http.StatusForbidden)
+	}
+
+	writeCacheHeaders(w, contentETag(content.Hash), isPrivate)
+	if content.Mime != "" {
+		w.Header().Set("Content-Type", content.Mime)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	var modified time.Time
+	if image.CreatedAt > 0 {
+		modified = time.Unix(image.CreatedAt, 0)
+	}
+	http.ServeContent(w, r, "", modified, bytes.NewReader(content.Data))
+}
+
+// checkEntitlement tells whether the buyer paid for the post, or subscribed
+// to the uploader. Payments are verified on Arweave once, the recorded
+// entitlement or subscription answers the later views.
+func checkEntitlement(r *http.Request, buyer string, tx string, uploader string, post string) (arweave.Payment, error) {
+	entitled, err := db.HasEntitlement(buyer, uploader, post)
+	if err != nil {
+		fmt.Println(err)
+	}
+	if !entitled {
+		entitled, err = db.HasActiveSubscription(buyer, uploader)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+	if entitled {
+		return arweave.Payment{Paid: true, Reason: arweave.PAYMENT_PAID}, nil
+	}
+
+	payment, err := Arweave.CheckPayment(r.Context(), buyer, tx, uploader, post)
+	if err != nil {
+		return payment, err
+	}
+	if payment.Paid {
+		err = db.AddEntitlement(db.Entitlement{
+			Buyer:     buyer,
+			Uploader:  uploader,
+			Post:      post,
+			PostTx:    tx,
+			PaymentTx: payment.Tx,
+			Amount:    payment.Amount,
+		})
+		if err != nil {
+			fmt.Println(err)
+		}
+		return payment, nil
+	}
+
+	subscription, err := Arweave.GetSubscription(r.Context(), buyer, uploader)
+	if err != nil {
+		return payment, err
+	}
+	if !subscription.Active {
+		// A lapsed subscription explains more than a missing payment.
+		if payment.Reason == arweave.PAYMENT_MISSING && subscription.Reason != arweave.PAYMENT_NO_PRICE {
+			payment.Reason = subscription.Reason
+		}
+		return payment, nil
+	}
+	err = db.PutSubscription(db.Subscription{
+		Subscriber: buyer,
+		Uploader:   uploader,
+		Tx:         subscription.Tx,
+		ExpiresAt:  subscription.ExpiresAt,
+	})
+	if err != nil {
+		fmt.Println(err)
+	}
+	return arweave.Payment{Paid: true, Reason: arweave.PAYMENT_PAID, Tx: subscription.Tx}, nil
+}
+
+func contentETag(hash string) string {
+	if hash == "" {
+		return ""
+	}
+	return `"` + hash + `"`
+}
+
+// etagMatches compares If-None-Match with the tag, weakly as the header
+// requires.
+func etagMatches(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if etag == "" || header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCacheHeaders lets shared caches keep public images forever, the
+// content behind a URL never changes. Private images may only be kept by the
+// viewer.
+func writeCacheHeaders(w http.ResponseWriter, etag string, isPrivate bool) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if isPrivate {
+		w.Header().Set("Cache-Control", PRIVATE_IMAGE_CACHE_CONTROL)
+		w.Header().Set("Vary", "Authorization")
+	} else {
+		w.Header().Set("Cache-Control", PUBLIC_IMAGE_CACHE_CONTROL)
+	}
+}
+
+func writeNotModified(w http.ResponseWriter, etag string, isPrivate bool) {
+	writeCacheHeaders(w, etag, isPrivate)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// needImage fetches an image from the peers. Peers that can't serve the
+// variant are asked for the original, which is then resized here.
+func needImage(fullId string, width int) ([]byte, error) {
+	if width == 0 {
+		return distributed.NeedById(fullId, "")
+	}
+	data, err := distributed.NeedById(fullId, strconv.Itoa(width))
+	if err == nil {
+		return data, nil
+	}
+
+	data, err = distributed.NeedById(fullId, "")
+	if err != nil {
+		return nil, err
+	}
+	info, err := media.Inspect(bytes.NewReader(data))
+	if err != nil || !media.CanResize(info, width) {
+		return data, nil
+	}
+	if variant, _, err := media.Resize(data, width); err == nil {
+		return variant, nil
+	}
+	return data, nil
+}
+
+// writeTeaser answers an unpaid or anonymous request for a private image
+// with 402 and its blurred preview, if the creator allows one. The reason the payment
+// check gave is sent in the X-Veracy-Payment header either way.
+func writeTeaser(w http.ResponseWriter, r *http.Request, fullId string, id int64, post string, wallet string, reason arweave.PaymentReason) {
+	var teaser []byte
+	var blurHash string
+	image, err := db.GetImage(id, post, wallet)
+	if err == nil {
+		if image.Active {
+			teaser, err = db.ReadImageTeaser(r.Context(), image)
+			blurHash = image.BlurHash
+		}
+	} else if err == db.ErrImageNotFound {
+		teaser, err = distributed.NeedById(fullId, distributed.TEASER_VARIANT)
+	}
+	w.Header().Set("Access-Control-Expose-Headers", PAYMENT_HEADER+", "+TEASER_HEADER+", "+BLURHASH_HEADER)
+	w.Header().Set(PAYMENT_HEADER, string(reason))
+	if err != nil || teaser == nil {
+		http.Error(w, reason.Message(), http.StatusPaymentRequired)
 		return
 	}
 
-	w.Write(imageData)
+	w.Header().Set(TEASER_HEADER, "true")
+	if blurHash != "" {
+		w.Header().Set(BLURHASH_HEADER, blurHash)
+	}
+	// The same URL serves the image once it is paid for.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", media.MIME_JPEG)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusPaymentRequired)
+	w.Write(teaser)
 }
 
 func AddFeedback(w http.ResponseWriter, r *http.Request) {
@@ -348,10 +567,27 @@ func AddFeedback(w http.ResponseWriter, r *http.Request) {
 }
 
 type UserInfo struct {
-	WalletID   string `json:"walletId"`
-	InboxCount int    `json:"inboxCount"`
-	ImageWidth int    `json:"imageWidth"`
-	ImageSize  int    `json:"imageSize"`
+	WalletID      string        `json:"walletId"`
+	InboxCount    int           `json:"inboxCount"`
+	ImageWidth    int           `json:"imageWidth"`
+	ImageSize     int           `json:"imageSize"`
+	MaxUploadSize int64         `json:"maxUploadSize"`
+	Usage         db.ImageUsage `json:"usage"`
+	Quota         db.ImageQuota `json:"quota"`
+	Remaining     db.ImageQuota `json:"remaining"`
+}
+
+// remainingQuota is zero where the quota is unlimited, matching the quota
+// itself.
+func remainingQuota(quota db.ImageQuota, usage db.ImageUsage) db.ImageQuota {
+	var remaining db.ImageQuota
+	if quota.Bytes > 0 {
+		remaining.Bytes = max(quota.Bytes-usage.Bytes, 0)
+	}
+	if quota.Images > 0 {
+		remaining.Images = max(quota.Images-usage.Images, 0)
+	}
+	return remaining
 }
 
 func GetInfo(w http.ResponseWriter, r *http.Request) {
@@ -363,11 +599,21 @@ func GetInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usage, err := db.GetImageUsage(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
 	info := UserInfo{
-		WalletID:   storedUser.WalletID,
-		ImageWidth: 1000,
-		ImageSize:  200,
-		InboxCount: inboxCount,
+		WalletID:      storedUser.WalletID,
+		ImageWidth:    1000,
+		ImageSize:     200,
+		InboxCount:    inboxCount,
+		MaxUploadSize: Uploads.MaxRequestSize,
+		Usage:         usage,
+		Quota:         Uploads.Quota,
+		Remaining:     remainingQuota(Uploads.Quota, usage),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -460,3 +706,17 @@ func MessageSaved(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	data, err := signing.JWKS()
+	if err != nil {
+		http.Error(w, "Failed to get keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(data)
+}
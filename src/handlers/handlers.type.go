@@ -3,6 +3,7 @@ package handlers
 import (
 	"time"
 
+	"github.com/acsermely/veracy.server/src/arweave"
 	"github.com/acsermely/veracy.server/src/db"
 )
 
@@ -16,20 +17,98 @@ type LoginKeyBody struct {
 	Chal     string `json:"challange"`
 }
 
+type LoginSignBody struct {
+	WalletID  string `json:"wallet"`
+	Signature string `json:"signature"`
+}
+
+type KeyChangeBody struct {
+	WalletID  string `json:"wallet"`
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	KeyID     int    `json:"keyId"`
+	Signature string `json:"signature"`
+	SignerKey string `json:"signerKey"`
+}
+
 type LoginAdminBody struct {
+	Name string `json:"name"`
 	Chal string `json:"challange"`
 }
 
+type AdminBody struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	Key  string `json:"key"`
+}
+
 const (
-	JWT_COOKIE_EXPIRATION = 24 * time.Hour
+	JWT_COOKIE_EXPIRATION   = 24 * time.Hour
+	ACCESS_TOKEN_EXPIRATION = 15 * time.Minute
+	LOGIN_SIGN_DOMAIN       = "veracy.server login"
+	ADMIN_CHALLENGE_WALLET  = "admin"
+	USER_TOKEN_AUDIENCE     = "veracy-user"
+	ADMIN_TOKEN_AUDIENCE    = "veracy-admin"
+	API_KEY_NAME_MAX_LENGTH = 64
+	UPLOAD_FIELD_MAX_LENGTH = 1024
+	TEASER_HEADER           = "X-Veracy-Teaser"
+	BLURHASH_HEADER         = "X-Veracy-BlurHash"
+	PAYMENT_HEADER          = "X-Veracy-Payment"
+	STRIPPED_HEADER         = "X-Veracy-Metadata-Removed"
+	UPLOAD_OFFSET_HEADER    = "Upload-Offset"
+	UPLOAD_LENGTH_HEADER    = "Upload-Length"
+	UPLOAD_CHUNK_TYPE       = "application/offset+octet-stream"
+	UPLOAD_SESSIONS_MAX     = 10
+
+	LIBRARY_PAGE_SIZE     = 50
+	LIBRARY_MAX_PAGE_SIZE = 200
+
+	PUBLIC_IMAGE_CACHE_CONTROL  = "public, max-age=31536000, immutable"
+	PRIVATE_IMAGE_CACHE_CONTROL = "private, max-age=86400"
 )
 
-type ImageData struct {
-	Id     int    `json:"id"`
-	Wallet string `json:"address"`
-	Post   string `json:"postId"`
-	Data   []byte `json:"data"`
-	Active bool   `json:"active"`
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+type RefreshBody struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type RevokeSessionBody struct {
+	ID string `json:"id"`
+}
+
+type CreateApiKeyBody struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// CreateApiKeyResponse carries the secret of a new API key, it is only ever
+// returned here.
+type CreateApiKeyResponse struct {
+	ApiKey db.ApiKey `json:"apiKey"`
+	Secret string    `json:"secret"`
+}
+
+type RevokeApiKeyBody struct {
+	ID int64 `json:"id"`
+}
+
+type UploadLimits struct {
+	MaxRequestSize int64
+	Quota          db.ImageQuota
+	// Resumable uploads collect their content in SessionDir, up to
+	// MaxSessionSize bytes each.
+	MaxSessionSize int64
+	SessionDir     string
+}
+
+type SessionInfo struct {
+	db.Session
+	Current bool `json:"current"`
 }
 
 type SetImageActiveBody struct {
@@ -39,6 +118,90 @@ type SetImageActiveBody struct {
 	Active bool   `json:"active"`
 }
 
+type CreateUploadBody struct {
+	Post   string `json:"postId"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+	Teaser *bool  `json:"teaser"`
+}
+
+type UploadSessionBody struct {
+	ID string `json:"id"`
+}
+
+type SetTeaserBody struct {
+	Id      int64  `json:"id"`
+	Post    string `json:"postId"`
+	Enabled bool   `json:"enabled"`
+}
+
+// DeleteImageBody carries the signature of the delete statement returned by
+// /deleteChallange, made with the wallet key or a device key of the wallet.
+type DeleteImageBody struct {
+	Id        int64  `json:"id"`
+	Post      string `json:"postId"`
+	Signature string `json:"signature"`
+	SignerKey string `json:"signerKey"`
+}
+
+// LibraryImage is the metadata of an image shown to its owner.
+type LibraryImage struct {
+	ID        int64  `json:"id"`
+	Post      string `json:"postId"`
+	Size      int64  `json:"size"`
+	Mime      string `json:"mime"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Active    bool   `json:"active"`
+	CreatedAt int64  `json:"createdAt"`
+	// Replicas is how many nodes hold the image. Peers fetch images on
+	// demand and don't keep them, so it is always 1, the uploading node.
+	Replicas int `json:"replicas"`
+}
+
+type MyImagesResponse struct {
+	Images []LibraryImage `json:"images"`
+	Next   int64          `json:"next,omitempty"`
+	Usage  db.ImageUsage  `json:"usage"`
+}
+
+type LibraryPost struct {
+	Post       string         `json:"postId"`
+	Images     []LibraryImage `json:"images"`
+	Size       int64          `json:"size"`
+	Active     int            `json:"active"`
+	LastUpload int64          `json:"lastUpload"`
+}
+
+type MyPostsResponse struct {
+	Posts []LibraryPost `json:"posts"`
+	Next  int64         `json:"next,omitempty"`
+	Usage db.ImageUsage `json:"usage"`
+}
+
+type MyPurchasesResponse struct {
+	Purchases []db.Entitlement `json:"purchases"`
+}
+
+type MySubscriptionsResponse struct {
+	Subscriptions []db.Subscription `json:"subscriptions"`
+}
+
+type TxCacheResponse struct {
+	Lookups arweave.CacheStats `json:"lookups"`
+	Stored  db.TxCacheStats    `json:"stored"`
+}
+
+// InvalidateTxBody names either a transaction or a data id.
+type InvalidateTxBody struct {
+	Tx     string `json:"tx"`
+	DataID string `json:"dataId"`
+}
+
+type InvalidateTxResponse struct {
+	Invalidated int64 `json:"invalidated"`
+}
+
 type FeedbackBody struct {
 	Type    string `json:"feedbackType"`
 	Target  string `json:"target"`
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/distributed"
+	"github.com/acsermely/veracy.server/src/keyring"
+)
+
+// localUserKeys returns the active keys of a wallet registered on this node.
+// Keys only cached from peers can't be changed here.
+func localUserKeys(wallet string) ([]db.UserKey, error) {
+	userKeys, err := db.GetUserKeys(wallet)
+	if err != nil {
+		return nil, err
+	}
+	for _, userKey := range userKeys {
+		if userKey.Cached {
+			return nil, fmt.Errorf("wallet is registered on another node")
+		}
+	}
+	if len(userKeys) == 0 {
+		return nil, fmt.Errorf("invalid Wallet ID")
+	}
+	return userKeys, nil
+}
+
+// walletSigners returns the keys a statement of the wallet may be signed
+// with: the active keys, narrowed down to the named signer key if there is
+// one, which may also be the wallet key itself.
+func walletSigners(wallet string, userKeys []db.UserKey, signerKey string) ([]string, error) {
+	if signerKey == "" {
+		return userKeyStrings(userKeys), nil
+	}
+
+	signers := []string{}
+	thumbprint, err := keyring.Thumbprint(signerKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse signer key")
+	}
+	for _, userKey := range userKeys {
+		if keyThumbprint, err := keyring.Thumbprint(userKey.Key); err == nil && keyThumbprint == thumbprint {
+			signers = append(signers, userKey.Key)
+		}
+	}
+	if arweave.VerifyKeyOwner(wallet, signerKey) == nil {
+		signers = append(signers, signerKey)
+	}
+	return signers, nil
+}
+
+// verifyKeyChange checks that the statement was signed by an active key of
+// the wallet, or by the wallet key itself, for an outstanding challenge. The
+// used challenge is deleted, a wrong signature burns all of them.
+func verifyKeyChange(wallet string, userKeys []db.UserKey, action string, subject string, body KeyChangeBody) (keyring.Proof, error) {
+	signature, err := keyring.DecodeSignature(body.Signature)
+	if err != nil {
+		return keyring.Proof{}, fmt.Errorf("invalid signature encoding")
+	}
+
+	signers, err := walletSigners(wallet, userKeys, body.SignerKey)
+	if err != nil {
+		return keyring.Proof{}, err
+	}
+
+	challenges, err := db.GetChallenges(wallet, db.CHALLENGE_PURPOSE_KEY_ROTATION)
+	if err != nil {
+		return keyring.Proof{}, err
+	}
+
+	message := func(nonce string) string {
+		return keyring.ChangeMessage(wallet, action, subject, nonce)
+	}
+	signed, signer := findSignedChallenge(signers, challenges, message, signature)
+	if signed == nil {
+		_ = db.FailChallenges(wallet, db.CHALLENGE_PURPOSE_KEY_ROTATION)
+		return keyring.Proof{}, fmt.Errorf("invalid signature")
+	}
+	if err := db.UseChallenge(*signed); err != nil {
+		return keyring.Proof{}, err
+	}
+
+	return keyring.Proof{
+		Message:   message(signed.Value),
+		Signature: body.Signature,
+		SignerKey: signer,
+	}, nil
+}
+
+func GetKeyChal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+
+	walletId := r.URL.Query().Get("walletId")
+	if walletId == "" {
+		http.Error(w, "Missing Wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := localUserKeys(walletId); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	nonce, err := db.CreateChallenge(walletId, db.CHALLENGE_PURPOSE_KEY_ROTATION)
+	if err != nil {
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(nonce))
+}
+
+func AddKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body KeyChangeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := parsePublicKeyString(body.Key); err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
+		return
+	}
+	thumbprint, err := keyring.Thumbprint(body.Key)
+	if err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusBadRequest)
+		return
+	}
+
+	userKeys, err := localUserKeys(body.WalletID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	for _, userKey := range userKeys {
+		if keyThumbprint, err := keyring.Thumbprint(userKey.Key); err == nil && keyThumbprint == thumbprint {
+			http.Error(w, "Key already registered", http.StatusConflict)
+			return
+		}
+	}
+
+	proof, err := verifyKeyChange(body.WalletID, userKeys, keyring.ACTION_ADD, thumbprint, body)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	proofData, err := json.Marshal(proof)
+	if err != nil {
+		http.Error(w, "Failed to add Key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.AddUserKey(body.WalletID, body.Key, body.Name, string(proofData)); err != nil {
+		http.Error(w, "Failed to add Key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := distributed.PublishKeyChange(body.WalletID); err != nil {
+		fmt.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func RevokeKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body KeyChangeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	userKeys, err := localUserKeys(body.WalletID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	revokedKey, err := db.GetUserKeyByID(body.WalletID, body.KeyID)
+	if err != nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if len(userKeys) == 1 {
+		http.Error(w, "Cannot revoke the last Key", http.StatusConflict)
+		return
+	}
+	thumbprint, err := keyring.Thumbprint(revokedKey.Key)
+	if err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusInternalServerError)
+		return
+	}
+
+	proof, err := verifyKeyChange(body.WalletID, userKeys, keyring.ACTION_REVOKE, thumbprint, body)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	proofData, err := json.Marshal(proof)
+	if err != nil {
+		http.Error(w, "Failed to revoke Key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := db.RevokeUserKey(body.WalletID, body.KeyID, thumbprint, string(proofData)); err != nil {
+		http.Error(w, "Failed to revoke Key", http.StatusInternalServerError)
+		return
+	}
+	if err := db.RevokeKeySessions(body.WalletID, thumbprint); err != nil {
+		fmt.Println(err)
+	}
+	announceRevokedSessions()
+
+	if err := distributed.PublishKeyChange(body.WalletID); err != nil {
+		fmt.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func ListKeys(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	userKeys, err := db.GetUserKeys(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userKeys)
+}
@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/db"
+)
+
+func libraryImage(image db.Image) LibraryImage {
+	return LibraryImage{
+		ID:        image.ID,
+		Post:      image.Post,
+		Size:      image.Size,
+		Mime:      image.Mime,
+		Width:     image.Width,
+		Height:    image.Height,
+		Active:    image.Active,
+		CreatedAt: image.CreatedAt,
+		Replicas:  1,
+	}
+}
+
+func parseImageFilter(r *http.Request) (db.ImageFilter, error) {
+	query := r.URL.Query()
+	filter := db.ImageFilter{
+		Post: query.Get("postId"),
+	}
+
+	if value := query.Get("active"); value != "" {
+		active, err := strconv.ParseBool(value)
+		if err != nil {
+			return db.ImageFilter{}, fmt.Errorf("invalid active filter")
+		}
+		filter.Active = &active
+	}
+
+	numbers := []struct {
+		name  string
+		value *int64
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+		{"before", &filter.Before},
+	}
+	for _, number := range numbers {
+		value := query.Get(number.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return db.ImageFilter{}, fmt.Errorf("invalid %s filter", number.name)
+		}
+		*number.value = parsed
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		return db.ImageFilter{}, err
+	}
+	filter.Limit = limit
+
+	return filter, nil
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return LIBRARY_PAGE_SIZE, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > LIBRARY_MAX_PAGE_SIZE {
+		return 0, fmt.Errorf("invalid limit")
+	}
+	return limit, nil
+}
+
+// MyImages lists the metadata of the images of the wallet, the newest
+// first. The next page starts before the id in Next.
+func MyImages(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	filter, err := parseImageFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	images, err := db.GetWalletImages(storedUser.WalletID, filter)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to get images", http.StatusInternalServerError)
+		return
+	}
+	usage, err := db.GetImageUsage(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	response := MyImagesResponse{
+		Images: make([]LibraryImage, 0, len(images)),
+		Usage:  usage,
+	}
+	for _, image := range images {
+		response.Images = append(response.Images, libraryImage(image))
+	}
+	if len(images) == filter.Limit {
+		response.Next = images[len(images)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MyPosts groups the images of the wallet by post, the post with the newest
+// upload first. The next page starts before the id in Next.
+func MyPosts(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	var before int64
+	if value := r.URL.Query().Get("before"); value != "" {
+		var err error
+		before, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || before < 0 {
+			http.Error(w, "invalid before filter", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	posts, err := db.GetWalletPosts(storedUser.WalletID, before, limit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to get posts", http.StatusInternalServerError)
+		return
+	}
+	usage, err := db.GetImageUsage(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	response := MyPostsResponse{Posts: make([]LibraryPost, 0, len(posts)), Usage: usage}
+	for _, walletPost := range posts {
+		images, err := db.GetWalletImages(storedUser.WalletID, db.ImageFilter{Post: walletPost.Post})
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to get images", http.StatusInternalServerError)
+			return
+		}
+		post := LibraryPost{Post: walletPost.Post, Images: make([]LibraryImage, 0, len(images))}
+		for _, image := range images {
+			post.Images = append(post.Images, libraryImage(image))
+			post.Size += image.Size
+			if image.Active {
+				post.Active++
+			}
+			post.LastUpload = max(post.LastUpload, image.CreatedAt)
+		}
+		response.Posts = append(response.Posts, post)
+	}
+	if len(posts) == limit {
+		response.Next = posts[len(posts)-1].Newest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MyPurchases lists the posts the wallet paid for, as far as the payments
+// were verified by this node.
+func MyPurchases(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	purchases, err := db.GetEntitlements(storedUser.WalletID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to get purchases", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MyPurchasesResponse{Purchases: purchases})
+}
+
+// MySubscriptions lists the active subscriptions of the wallet with their
+// expiry, read from the chain. The subscriptions recorded by this node are
+// listed when the chain can't be read.
+func MySubscriptions(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	response := MySubscriptionsResponse{Subscriptions: []db.Subscription{}}
+	subscriptions, err := Arweave.GetSubscriptions(r.Context(), storedUser.WalletID)
+	if err == nil {
+		for _, subscription := range subscriptions {
+			if !subscription.Active {
+				continue
+			}
+			active := db.Subscription{
+				Subscriber: storedUser.WalletID,
+				Uploader:   subscription.Uploader,
+				Tx:         subscription.Tx,
+				ExpiresAt:  subscription.ExpiresAt,
+				VerifiedAt: time.Now().Unix(),
+			}
+			if err := db.PutSubscription(active); err != nil {
+				fmt.Println(err)
+			}
+			response.Subscriptions = append(response.Subscriptions, active)
+		}
+		sort.Slice(response.Subscriptions, func(i, j int) bool {
+			return response.Subscriptions[i].ExpiresAt < response.Subscriptions[j].ExpiresAt
+		})
+	} else {
+		fmt.Println(err)
+		response.Subscriptions, err = db.GetActiveSubscriptions(storedUser.WalletID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to get subscriptions", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -2,71 +2,90 @@ package handlers
 
 import (
 	"context"
-	"fmt"
 	"net/http"
-	"os"
-	"strings"
 
 	"github.com/acsermely/veracy.server/src/db"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 type key int
 
 const (
 	CONTEXT_USER_OBJECT_KEY key = 0
+	CONTEXT_SESSION_KEY     key = 1
+	CONTEXT_ADMIN_KEY       key = 2
+	CONTEXT_API_KEY         key = 3
 )
 
+// WalletMiddleware authenticates the request with a user access token.
+// API keys are not accepted, see ScopedWalletMiddleware.
 func WalletMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return walletMiddleware("", next)
+}
+
+// ScopedWalletMiddleware authenticates the request with a user access token
+// or with an API key that was granted the scope.
+func ScopedWalletMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return walletMiddleware(scope, next)
+}
+
+func walletMiddleware(scope string, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+UPLOAD_OFFSET_HEADER)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PATCH, OPTIONS")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		secret := []byte(os.Getenv("SECRET"))
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		if r.Header.Get("Authorization") == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Missing token"))
 			return
 		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return secret, nil
-		})
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized"))
-			return
-		}
 
 		var userWallet string
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			userWallet = claims["user"].(string)
+		ctx := r.Context()
+		if secret, ok := apiKeyFromRequest(r); ok {
+			if scope == "" {
+				http.Error(w, "API keys are not accepted here", http.StatusForbidden)
+				return
+			}
+			apiKey, err := db.GetApiKeyBySecret(secret)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Unauthorized"))
+				return
+			}
+			if !apiKey.HasScope(scope) {
+				http.Error(w, "Missing scope "+scope, http.StatusForbidden)
+				return
+			}
+			userWallet = apiKey.Wallet
+			ctx = context.WithValue(ctx, CONTEXT_API_KEY, apiKey)
 		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Unauthorized"))
-			return
+			wallet, sessionId, err := parseUserToken(r)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Unauthorized"))
+				return
+			}
+			userWallet = wallet
+			ctx = context.WithValue(ctx, CONTEXT_SESSION_KEY, sessionId)
 		}
 
-		keyEntry, err := db.GetUserKey(userWallet)
+		keyEntry, err := loadUserKey(userWallet)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusUnauthorized)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), CONTEXT_USER_OBJECT_KEY, keyEntry)
+		ctx = context.WithValue(ctx, CONTEXT_USER_OBJECT_KEY, keyEntry)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+func AdminMiddleware(role string, next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
@@ -75,26 +94,24 @@ func AdminMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		secret := []byte(os.Getenv("SECRET"))
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
+		if r.Header.Get("Authorization") == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Missing token"))
 			return
 		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		_, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return secret, nil
-		})
+		admin, err := parseAdminToken(r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized"))
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		if !db.AdminRoleAllows(admin.Role, role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), CONTEXT_ADMIN_KEY, admin)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
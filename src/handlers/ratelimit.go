@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/db"
+)
+
+const (
+	RATE_LIMIT_BUCKET_IDLE   = 10 * time.Minute
+	RATE_LIMIT_SWEEP_EVERY   = time.Minute
+	RATE_LIMIT_MAX_BODY_SIZE = 1 << 20
+
+	// Failed challenges before a wallet is locked out, and how the lockout
+	// grows with every further failure.
+	LOCKOUT_THRESHOLD = 3
+	LOCKOUT_BASE      = 30 * time.Second
+	LOCKOUT_MAX       = 24 * time.Hour
+)
+
+// RateLimit configures the throttling of a route. Requests are limited per
+// client IP and, if Wallet is set, per wallet. LockoutPurpose enables the
+// lockout of wallets that failed too many challenges of that purpose.
+type RateLimit struct {
+	IPRate         float64
+	IPBurst        int
+	WalletRate     float64
+	WalletBurst    int
+	Wallet         func(r *http.Request) string
+	LockoutPurpose string
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a set of token buckets refilled with rate tokens per second up
+// to burst.
+type limiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 || burst <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for the key. If the bucket is empty it returns how
+// long to wait for the next one.
+func (l *limiter) allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > RATE_LIMIT_SWEEP_EVERY {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > RATE_LIMIT_BUCKET_IDLE {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// lockoutRemaining returns how long the wallet is still locked out after
+// repeated failed challenges. The lockout doubles with every failure above
+// LOCKOUT_THRESHOLD.
+func lockoutRemaining(wallet string, purpose string) time.Duration {
+	attempts, lastFailedAt, err := db.GetChallengeFailures(wallet, purpose)
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+	if attempts < LOCKOUT_THRESHOLD {
+		return 0
+	}
+
+	exponent := math.Min(float64(attempts-LOCKOUT_THRESHOLD), 32)
+	lockout := time.Duration(math.Min(float64(LOCKOUT_BASE)*math.Pow(2, exponent), float64(LOCKOUT_MAX)))
+	return time.Until(lastFailedAt.Add(lockout))
+}
+
+func tooManyRequests(w http.ResponseWriter, wait time.Duration, message string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+func RateLimitMiddleware(limit RateLimit, next http.HandlerFunc) http.HandlerFunc {
+	ipLimiter := newLimiter(limit.IPRate, limit.IPBurst)
+	walletLimiter := newLimiter(limit.WalletRate, limit.WalletBurst)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+
+		if ok, wait := ipLimiter.allow(clientIP(r)); !ok {
+			tooManyRequests(w, wait, "Too many requests")
+			return
+		}
+
+		if limit.Wallet == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		wallet := limit.Wallet(r)
+		if wallet == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := walletLimiter.allow(wallet); !ok {
+			tooManyRequests(w, wait, "Too many requests")
+			return
+		}
+
+		if limit.LockoutPurpose != "" {
+			if wait := lockoutRemaining(wallet, limit.LockoutPurpose); wait > 0 {
+				tooManyRequests(w, wait, "Too many failed attempts")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func WalletFromQuery(r *http.Request) string {
+	return r.URL.Query().Get("walletId")
+}
+
+// WalletFromBody reads the "wallet" field of a JSON body and restores the
+// body for the handler.
+func WalletFromBody(r *http.Request) string {
+	return stringFromBody(r, "wallet")
+}
+
+func AdminFromQuery(r *http.Request) string {
+	return adminChallengeWallet(adminName(r.URL.Query().Get("name")))
+}
+
+func AdminFromBody(r *http.Request) string {
+	return adminChallengeWallet(adminName(stringFromBody(r, "name")))
+}
+
+func stringFromBody(r *http.Request, field string) string {
+	if r.Body == nil {
+		return ""
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, RATE_LIMIT_MAX_BODY_SIZE))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return ""
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return ""
+	}
+	value, _ := body[field].(string)
+	return value
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/media"
+)
+
+// Resumable uploads send the content of an image in chunks, in the manner
+// of the tus protocol: a session is created with the size and SHA-256 hash
+// of the file, chunks are appended at the current offset and the finished
+// session is stored like a single request upload.
+
+var (
+	errUploadBusy       = errors.New("upload session is busy")
+	errUploadIncomplete = errors.New("upload is incomplete")
+	errUploadHash       = errors.New("upload hash mismatch")
+)
+
+// busyUploads holds the sessions a request is working on, so chunks of one
+// session are never written concurrently.
+var (
+	busyUploads      = make(map[string]bool)
+	busyUploadsMutex sync.Mutex
+)
+
+func lockUpload(id string) bool {
+	busyUploadsMutex.Lock()
+	defer busyUploadsMutex.Unlock()
+	if busyUploads[id] {
+		return false
+	}
+	busyUploads[id] = true
+	return true
+}
+
+func unlockUpload(id string) {
+	busyUploadsMutex.Lock()
+	defer busyUploadsMutex.Unlock()
+	delete(busyUploads, id)
+}
+
+func isValidContentHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size && hex.EncodeToString(decoded) == hash
+}
+
+func writeUploadOffset(w http.ResponseWriter, session db.UploadSession) {
+	w.Header().Set("Access-Control-Expose-Headers", UPLOAD_OFFSET_HEADER+", "+UPLOAD_LENGTH_HEADER)
+	w.Header().Set(UPLOAD_OFFSET_HEADER, strconv.FormatInt(session.Offset, 10))
+	w.Header().Set(UPLOAD_LENGTH_HEADER, strconv.FormatInt(session.Size, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func writeUploadSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrUploadSessionNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, errUploadBusy):
+		http.Error(w, "Upload is busy", http.StatusConflict)
+	case errors.Is(err, db.ErrUploadOffsetMismatch):
+		http.Error(w, "Upload offset mismatch", http.StatusConflict)
+	case errors.Is(err, errUploadIncomplete):
+		http.Error(w, "Upload is incomplete", http.StatusConflict)
+	case errors.Is(err, errUploadHash):
+		http.Error(w, "Upload hash mismatch", http.StatusUnprocessableEntity)
+	default:
+		writeUploadError(w, err)
+	}
+}
+
+// CreateUpload opens a resumable upload for the wallet.
+func CreateUpload(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body CreateUploadBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if body.Size <= 0 || len(body.Post) > UPLOAD_FIELD_MAX_LENGTH || !isValidContentHash(body.Hash) {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if Uploads.MaxSessionSize > 0 && body.Size > Uploads.MaxSessionSize {
+		http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	count, err := db.CountUploadSessions(storedUser.WalletID)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if count >= UPLOAD_SESSIONS_MAX {
+		http.Error(w, "Too many unfinished uploads", http.StatusTooManyRequests)
+		return
+	}
+	if err := db.CheckImageQuota(storedUser.WalletID, body.Size, Uploads.Quota); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	session, err := db.CreateUploadSession(db.UploadSession{
+		Wallet: storedUser.WalletID,
+		Post:   body.Post,
+		Size:   body.Size,
+		Hash:   body.Hash,
+		Teaser: body.Teaser == nil || *body.Teaser,
+	}, Uploads.SessionDir)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	writeUploadOffset(w, session)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// GetUploadOffset tells how much of a resumable upload was received, so an
+// interrupted client knows where to continue.
+func GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := db.GetUploadSession(r.URL.Query().Get("id"), storedUser.WalletID)
+	if err != nil {
+		writeUploadSessionError(w, err)
+		return
+	}
+
+	writeUploadOffset(w, session)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// UploadChunk appends the body to a resumable upload. The Upload-Offset
+// header has to match the received size, a chunk is never applied twice.
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType != UPLOAD_CHUNK_TYPE {
+		http.Error(w, "Chunks are sent as "+UPLOAD_CHUNK_TYPE, http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(UPLOAD_OFFSET_HEADER), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid "+UPLOAD_OFFSET_HEADER, http.StatusBadRequest)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if !lockUpload(id) {
+		writeUploadSessionError(w, errUploadBusy)
+		return
+	}
+	defer unlockUpload(id)
+
+	session, err := db.GetUploadSession(id, storedUser.WalletID)
+	if err != nil {
+		writeUploadSessionError(w, err)
+		return
+	}
+	if offset != session.Offset {
+		writeUploadOffset(w, session)
+		writeUploadSessionError(w, db.ErrUploadOffsetMismatch)
+		return
+	}
+
+	remaining := session.Size - session.Offset
+	if r.ContentLength > remaining {
+		writeUploadOffset(w, session)
+		http.Error(w, "Chunk exceeds the upload size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, remaining)
+
+	file, err := os.OpenFile(session.Path, os.O_WRONLY, 0)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Seek(session.Offset, io.SeekStart); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	// Whatever arrived before the connection broke is kept, the client
+	// continues from the new offset.
+	written, copyErr := io.Copy(file, body)
+	if written > 0 {
+		session, err = db.AdvanceUploadSession(session, offset, offset+written)
+		if err != nil {
+			writeUploadSessionError(w, err)
+			return
+		}
+	}
+	writeUploadOffset(w, session)
+	if copyErr != nil {
+		writeUploadError(w, copyErr)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyUploadHash checks the received content against the hash the session
+// was created with.
+func verifyUploadHash(file *os.File, session db.UploadSession) error {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.LimitReader(file, session.Size)); err != nil {
+		return err
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != session.Hash {
+		return errUploadHash
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	return err
+}
+
+// FinishUpload stores a complete resumable upload as an image. The session
+// is closed unless storing failed for a reason a retry could fix.
+func FinishUpload(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body UploadSessionBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if !lockUpload(body.ID) {
+		writeUploadSessionError(w, errUploadBusy)
+		return
+	}
+	defer unlockUpload(body.ID)
+
+	session, err := db.GetUploadSession(body.ID, storedUser.WalletID)
+	if err != nil {
+		writeUploadSessionError(w, err)
+		return
+	}
+	if session.Offset != session.Size {
+		writeUploadOffset(w, session)
+		writeUploadSessionError(w, errUploadIncomplete)
+		return
+	}
+
+	image, err := storeUploadSession(r, session)
+	if err == nil || errors.Is(err, errUploadHash) || errors.Is(err, media.ErrUnsupportedFormat) || errors.Is(err, media.ErrInvalidImage) {
+		if deleteErr := db.DeleteUploadSession(session.ID, session.Wallet); deleteErr != nil {
+			fmt.Println(deleteErr)
+		}
+	}
+	if err != nil {
+		writeUploadSessionError(w, err)
+		return
+	}
+	writeUploadResult(w, image)
+}
+
+func storeUploadSession(r *http.Request, session db.UploadSession) (db.Image, error) {
+	file, err := os.Open(session.Path)
+	if err != nil {
+		return db.Image{}, err
+	}
+	defer file.Close()
+	if err := verifyUploadHash(file, session); err != nil {
+		return db.Image{}, err
+	}
+
+	upload, err := stageUpload(io.LimitReader(file, session.Size))
+	if err != nil {
+		return db.Image{}, err
+	}
+	defer upload.Close()
+
+	return storeUpload(r.Context(), session.Wallet, session.Post, session.Teaser, upload)
+}
+
+// CancelUpload drops a resumable upload with the content received so far.
+func CancelUpload(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body UploadSessionBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if !lockUpload(body.ID) {
+		writeUploadSessionError(w, errUploadBusy)
+		return
+	}
+	defer unlockUpload(body.ID)
+
+	if err := db.DeleteUploadSession(body.ID, storedUser.WalletID); err != nil {
+		writeUploadSessionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/distributed"
+	"github.com/acsermely/veracy.server/src/signing"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func createUserToken(wallet string, sessionId string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ACCESS_TOKEN_EXPIRATION)
+
+	tokenString, err := signing.Sign(jwt.MapClaims{
+		"authorized": true,
+		"user":       wallet,
+		"sid":        sessionId,
+		"aud":        USER_TOKEN_AUDIENCE,
+		"exp":        expiresAt.Unix(),
+	})
+	return tokenString, expiresAt, err
+}
+
+// parseUserToken validates the bearer token of the request and returns the
+// wallet and session it was issued for. Tokens of group peers are accepted
+// as well, unless the issuing node announced their session as revoked.
+func parseUserToken(r *http.Request) (string, string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", "", fmt.Errorf("missing token")
+	}
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+
+	token, local, err := signing.Parse(tokenString)
+	if err != nil {
+		return "", "", err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid || !claims.VerifyAudience(USER_TOKEN_AUDIENCE, true) {
+		return "", "", fmt.Errorf("invalid token")
+	}
+	wallet, ok := claims["user"].(string)
+	if !ok || wallet == "" {
+		return "", "", fmt.Errorf("invalid token user")
+	}
+	sessionId, ok := claims["sid"].(string)
+	if !ok || sessionId == "" {
+		return "", "", fmt.Errorf("invalid token session")
+	}
+
+	if local {
+		if _, err := db.GetActiveSession(sessionId, wallet); err != nil {
+			return "", "", err
+		}
+	} else {
+		issuer, _ := claims["iss"].(string)
+		revoked, err := db.IsPeerSessionRevoked(issuer, sessionId)
+		if err != nil {
+			return "", "", err
+		}
+		if revoked {
+			return "", "", fmt.Errorf("session revoked")
+		}
+	}
+
+	return wallet, sessionId, nil
+}
+
+// announceRevokedSessions tells the group right away about revoked
+// sessions, instead of with the next signing key announcement.
+func announceRevokedSessions() {
+	if err := distributed.PublishSigningKeys(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession opens a new session for a wallet freshly logged in with the
+// key, named by its thumbprint, and writes the access and refresh tokens to
+// the response.
+func startSession(w http.ResponseWriter, r *http.Request, wallet string, key string) {
+	session, refreshToken, err := db.CreateSession(wallet, key, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Error creating session", http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, session, refreshToken)
+}
+
+func writeTokens(w http.ResponseWriter, session db.Session, refreshToken string) {
+	tokenString, expiresAt, err := createUserToken(session.Wallet, session.ID)
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TokenResponse{
+		Token:        tokenString,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt.Unix(),
+	})
+}
+
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body RefreshBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	session, refreshToken, err := db.RotateSession(body.RefreshToken)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := db.GetUserKey(session.Wallet); err != nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return
+	}
+
+	writeTokens(w, session, refreshToken)
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+	sessionId := r.Context().Value(CONTEXT_SESSION_KEY).(string)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := db.RevokeSession(storedUser.WalletID, sessionId); err != nil {
+		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		return
+	}
+	announceRevokedSessions()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := db.RevokeAllSessions(storedUser.WalletID); err != nil {
+		http.Error(w, "Failed to logout", http.StatusInternalServerError)
+		return
+	}
+	announceRevokedSessions()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+	sessionId := r.Context().Value(CONTEXT_SESSION_KEY).(string)
+
+	sessions, err := db.GetSessions(storedUser.WalletID)
+	if err != nil {
+		http.Error(w, "Failed to get sessions", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionInfo{
+			Session: session,
+			Current: session.ID == sessionId,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body RevokeSessionBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ID == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.RevokeSession(storedUser.WalletID, body.ID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	announceRevokedSessions()
+
+	w.WriteHeader(http.StatusOK)
+}
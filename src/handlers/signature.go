@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/keyring"
+)
+
+// loginSignMessage builds the domain separated text the wallet has to sign,
+// so a signature made for this server can't be replayed as anything else.
+func loginSignMessage(wallet string, nonce string) string {
+	return fmt.Sprintf("%s\nWallet: %s\nNonce: %s", LOGIN_SIGN_DOMAIN, wallet, nonce)
+}
+
+// findSignedChallenge returns the outstanding challenge and the key the
+// signature was made with, trying every combination of the two.
+func findSignedChallenge(keys []string, challenges []db.Challenge, message func(nonce string) string, signature []byte) (*db.Challenge, string) {
+	for _, key := range keys {
+		rsaPublicKey, err := parsePublicKeyString(key)
+		if err != nil {
+			continue
+		}
+		for i, chal := range challenges {
+			if keyring.VerifySignature(rsaPublicKey, []byte(message(chal.Value)), signature) == nil {
+				return &challenges[i], key
+			}
+		}
+	}
+	return nil, ""
+}
+
+func userKeyStrings(userKeys []db.UserKey) []string {
+	keys := make([]string, 0, len(userKeys))
+	for _, userKey := range userKeys {
+		keys = append(keys, userKey.Key)
+	}
+	return keys
+}
+
+func GetSignChal(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+
+	walletId := r.URL.Query().Get("walletId")
+	if walletId == "" {
+		http.Error(w, "Missing Wallet ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := loadUserKey(walletId); err != nil {
+		fmt.Println(err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	nonce, err := db.CreateChallenge(walletId, db.CHALLENGE_PURPOSE_LOGIN_SIGN)
+	if err != nil {
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(loginSignMessage(walletId, nonce)))
+}
+
+func LoginWithSignature(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var loginCreds LoginSignBody
+	if err := json.NewDecoder(r.Body).Decode(&loginCreds); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	userKeys, err := db.GetUserKeys(loginCreds.WalletID)
+	if err != nil || len(userKeys) == 0 {
+		http.Error(w, "invalid Wallet ID", http.StatusUnauthorized)
+		return
+	}
+
+	signature, err := keyring.DecodeSignature(loginCreds.Signature)
+	if err != nil {
+		http.Error(w, "Invalid Signature encoding", http.StatusBadRequest)
+		return
+	}
+
+	challenges, err := db.GetChallenges(loginCreds.WalletID, db.CHALLENGE_PURPOSE_LOGIN_SIGN)
+	if err != nil {
+		http.Error(w, "Failed to check Challange", http.StatusInternalServerError)
+		return
+	}
+
+	signed, signer := findSignedChallenge(userKeyStrings(userKeys), challenges, func(nonce string) string {
+		return loginSignMessage(loginCreds.WalletID, nonce)
+	}, signature)
+	if signed == nil {
+		_ = db.FailChallenges(loginCreds.WalletID, db.CHALLENGE_PURPOSE_LOGIN_SIGN)
+		http.Error(w, "Invalid Signature", http.StatusUnauthorized)
+		return
+	}
+
+	if err := db.UseChallenge(*signed); err != nil {
+		http.Error(w, "Invalid Challange", http.StatusUnauthorized)
+		return
+	}
+
+	thumbprint, err := keyring.Thumbprint(signer)
+	if err != nil {
+		http.Error(w, "Cannot parse Key", http.StatusInternalServerError)
+		return
+	}
+
+	startSession(w, r, loginCreds.WalletID, thumbprint)
+}
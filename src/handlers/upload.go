@@ -0,0 +1,553 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/acsermely/veracy.server/src/distributed"
+	"github.com/acsermely/veracy.server/src/keyring"
+	"github.com/acsermely/veracy.server/src/media"
+)
+
+// Uploads is set up from the command line flags on startup.
+var Uploads UploadLimits
+
+// Arweave reads posts and payments, set up from the command line flags on
+// startup.
+var Arweave *arweave.Client
+
+// OrphanGrace is how old an unreferenced upload has to be to count as
+// orphaned, set up from the command line flags on startup.
+var OrphanGrace time.Duration
+
+var (
+	errWalletMismatch = errors.New("wallet doesn't match the authenticated user")
+	errMissingImage   = errors.New("missing image")
+	errInvalidForm    = errors.New("invalid request payload")
+	errInvalidTeaser  = errors.New("invalid teaser value")
+)
+
+// stagedUpload is an uploaded image written to a temporary file, checked,
+// stripped of its metadata and hashed before it goes to the blob store.
+type stagedUpload struct {
+	file     *os.File
+	hash     string
+	size     int64
+	info     media.Info
+	stripped *media.StripReport
+}
+
+func removeTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// stageUpload streams the content to a temporary file. The format is sniffed
+// before anything is written, so other content is rejected early. JPEG and
+// PNG metadata is removed while the content is copied to the staged file.
+func stageUpload(r io.Reader) (*stagedUpload, error) {
+	reader := bufio.NewReader(r)
+	header, _ := reader.Peek(media.SNIFF_LENGTH)
+	if _, err := media.Sniff(header); err != nil {
+		return nil, err
+	}
+
+	raw, err := os.CreateTemp("", "veracy-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(raw)
+	if _, err := io.Copy(raw, reader); err != nil {
+		return nil, err
+	}
+	if _, err := raw.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	info, err := media.Inspect(raw)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := raw.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp("", "veracy-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	upload := &stagedUpload{file: file}
+
+	hasher := sha256.New()
+	out := io.MultiWriter(file, hasher)
+	if media.CanStrip(info.Mime) {
+		var report media.StripReport
+		report, err = media.StripMetadata(raw, out, info.Mime)
+		upload.stripped = &report
+	} else {
+		_, err = io.Copy(out, raw)
+	}
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	upload.hash = hex.EncodeToString(hasher.Sum(nil))
+
+	if upload.size, err = file.Seek(0, io.SeekCurrent); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		upload.Close()
+		return nil, err
+	}
+	// Rotating swaps the dimensions, so they are read again.
+	upload.info, err = media.Inspect(file)
+	if err != nil {
+		upload.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		upload.Close()
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (u *stagedUpload) Close() {
+	removeTemp(u.file)
+}
+
+// stageImageField stages an image sent as a plain form value. Older clients
+// send a data URL, its payload is decoded and handled like a file upload.
+func stageImageField(r io.Reader) (*stagedUpload, error) {
+	reader := bufio.NewReader(r)
+	prefix, _ := reader.Peek(len("data:"))
+	if !media.IsDataURL(string(prefix)) {
+		return stageUpload(reader)
+	}
+
+	dataURL, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err := media.ParseDataURL(string(dataURL))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", media.ErrInvalidImage, err)
+	}
+	return stageUpload(bytes.NewReader(data))
+}
+
+// uploadForm holds the fields of an upload request.
+type uploadForm struct {
+	postId string
+	teaser bool
+	upload *stagedUpload
+}
+
+// parseTeaser reads the teaser field, teasers are on unless the creator
+// turns them off.
+func parseTeaser(value string) (bool, error) {
+	if value == "" {
+		return true, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errInvalidTeaser
+	}
+	return enabled, nil
+}
+
+func readFormField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, UPLOAD_FIELD_MAX_LENGTH+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > UPLOAD_FIELD_MAX_LENGTH {
+		return "", errInvalidForm
+	}
+	return string(value), nil
+}
+
+// readMultipartUpload streams the parts of the request, so the image never
+// has to be held in memory.
+func readMultipartUpload(r *http.Request, wallet string) (uploadForm, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return uploadForm{}, errInvalidForm
+	}
+
+	form := uploadForm{teaser: true}
+	fail := func(err error) (uploadForm, error) {
+		if form.upload != nil {
+			form.upload.Close()
+		}
+		return uploadForm{}, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		switch part.FormName() {
+		case "id":
+			form.postId, err = readFormField(part)
+		case "walletId":
+			var walletId string
+			walletId, err = readFormField(part)
+			if err == nil && walletId != "" && walletId != wallet {
+				err = errWalletMismatch
+			}
+		case "teaser":
+			var teaser string
+			teaser, err = readFormField(part)
+			if err == nil {
+				form.teaser, err = parseTeaser(teaser)
+			}
+		case "image":
+			if form.upload != nil {
+				err = errInvalidForm
+			} else if part.FileName() != "" {
+				form.upload, err = stageUpload(part)
+			} else {
+				form.upload, err = stageImageField(part)
+			}
+		}
+		part.Close()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if form.upload == nil {
+		return fail(errMissingImage)
+	}
+	return form, nil
+}
+
+// readFormUpload handles the url encoded form of older clients.
+func readFormUpload(r *http.Request, wallet string) (uploadForm, error) {
+	if err := r.ParseForm(); err != nil {
+		return uploadForm{}, err
+	}
+
+	// walletId used to decide the owner, it is only checked now.
+	if walletId := r.FormValue("walletId"); walletId != "" && walletId != wallet {
+		return uploadForm{}, errWalletMismatch
+	}
+
+	teaser, err := parseTeaser(r.FormValue("teaser"))
+	if err != nil {
+		return uploadForm{}, err
+	}
+
+	imageData := r.FormValue("image")
+	if imageData == "" {
+		return uploadForm{}, errMissingImage
+	}
+	upload, err := stageImageField(bytes.NewReader([]byte(imageData)))
+	if err != nil {
+		return uploadForm{}, err
+	}
+	return uploadForm{
+		postId: r.FormValue("id"),
+		teaser: teaser,
+		upload: upload,
+	}, nil
+}
+
+func Upload(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if Uploads.MaxRequestSize > 0 {
+		if r.ContentLength > Uploads.MaxRequestSize {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, Uploads.MaxRequestSize)
+	}
+
+	// Fail before reading the body if the wallet can't store anything more.
+	if err := db.CheckImageQuota(storedUser.WalletID, 0, Uploads.Quota); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	var form uploadForm
+	var err error
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "multipart/form-data" {
+		form, err = readMultipartUpload(r, storedUser.WalletID)
+	} else {
+		form, err = readFormUpload(r, storedUser.WalletID)
+	}
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	upload := form.upload
+	defer upload.Close()
+
+	image, err := storeUpload(r.Context(), storedUser.WalletID, form.postId, form.teaser, upload)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeUploadResult(w, image)
+}
+
+// storeUpload moves a staged upload to the blob store and records it as an
+// image of the wallet. The teaser and feed variants are prepared in the
+// background.
+func storeUpload(ctx context.Context, wallet string, postId string, teaser bool, upload *stagedUpload) (db.Image, error) {
+	if err := db.CheckImageQuota(wallet, upload.size, Uploads.Quota); err != nil {
+		return db.Image{}, err
+	}
+
+	if err := db.Blobs.Put(ctx, upload.hash, upload.file, upload.size); err != nil {
+		return db.Image{}, err
+	}
+
+	image := db.Image{
+		Wallet:   wallet,
+		Post:     postId,
+		Hash:     upload.hash,
+		Size:     upload.size,
+		Mime:     upload.info.Mime,
+		Width:    upload.info.Width,
+		Height:   upload.info.Height,
+		Teaser:   teaser,
+		Stripped: upload.stripped,
+	}
+	var err error
+	image.ID, err = db.InsertImage(image, Uploads.Quota)
+	if err != nil {
+		// The quota may have run out since the check above.
+		db.DeleteUnusedBlob(ctx, upload.hash)
+		return db.Image{}, err
+	}
+	go func() {
+		db.PrepareImageTeaser(image)
+		db.PrepareImageVariants(image)
+	}()
+	return image, nil
+}
+
+// writeUploadResult answers a stored upload with the id of the image.
+func writeUploadResult(w http.ResponseWriter, image db.Image) {
+	if image.Stripped != nil && len(image.Stripped.Removed) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", STRIPPED_HEADER)
+		w.Header().Set(STRIPPED_HEADER, strings.Join(image.Stripped.Removed, ", "))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%d", image.ID)
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, db.ErrImageBytesQuota):
+		http.Error(w, "Storage quota exceeded", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, db.ErrImageCountQuota):
+		http.Error(w, "Image count quota exceeded", http.StatusTooManyRequests)
+	case errors.Is(err, media.ErrUnsupportedFormat):
+		http.Error(w, "Unsupported image format, use JPEG, PNG, GIF or WebP", http.StatusUnsupportedMediaType)
+	case errors.Is(err, media.ErrInvalidImage):
+		http.Error(w, "Invalid image", http.StatusBadRequest)
+	case errors.Is(err, errWalletMismatch):
+		http.Error(w, "Wallet doesn't match the authenticated user", http.StatusForbidden)
+	case errors.Is(err, errMissingImage):
+		http.Error(w, "Missing image", http.StatusBadRequest)
+	case errors.Is(err, errInvalidTeaser):
+		http.Error(w, "Invalid teaser value, use true or false", http.StatusBadRequest)
+	case errors.Is(err, errInvalidForm):
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	default:
+		fmt.Println(err)
+		http.Error(w, "Failed to store image", http.StatusInternalServerError)
+	}
+}
+
+// SetTeaser lets the creator turn the teaser of one of their images on or
+// off.
+func SetTeaser(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body SetTeaserBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	image, err := db.SetImageTeaser(storedUser.WalletID, body.Id, body.Post, body.Enabled)
+	if err != nil {
+		if err == db.ErrImageNotFound {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Failed to update teaser", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(image)
+}
+
+// GetDeleteChal returns the statement the wallet signs to delete one of its
+// images. Peers only honor a delete the owner of the wallet signed.
+func GetDeleteChal(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid image ID", http.StatusBadRequest)
+		return
+	}
+	image, err := db.GetImage(id, r.URL.Query().Get("postId"), storedUser.WalletID)
+	if err != nil {
+		if err == db.ErrImageNotFound {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := db.CreateChallenge(storedUser.WalletID, db.CHALLENGE_PURPOSE_IMAGE_DELETE)
+	if err != nil {
+		http.Error(w, "Couldn't generate Challange", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(keyring.DeleteMessage(image.Wallet, image.Post, image.ID, image.Hash, nonce)))
+}
+
+// verifyDelete checks that the delete statement of the image was signed by
+// a key of the wallet for an outstanding challenge.
+func verifyDelete(image db.Image, body DeleteImageBody) (keyring.Proof, error) {
+	signature, err := keyring.DecodeSignature(body.Signature)
+	if err != nil {
+		return keyring.Proof{}, fmt.Errorf("invalid signature encoding")
+	}
+	userKeys, err := db.GetUserKeys(image.Wallet)
+	if err != nil {
+		return keyring.Proof{}, err
+	}
+	signers, err := walletSigners(image.Wallet, userKeys, body.SignerKey)
+	if err != nil {
+		return keyring.Proof{}, err
+	}
+
+	challenges, err := db.GetChallenges(image.Wallet, db.CHALLENGE_PURPOSE_IMAGE_DELETE)
+	if err != nil {
+		return keyring.Proof{}, err
+	}
+
+	message := func(nonce string) string {
+		return keyring.DeleteMessage(image.Wallet, image.Post, image.ID, image.Hash, nonce)
+	}
+	signed, signer := findSignedChallenge(signers, challenges, message, signature)
+	if signed == nil {
+		_ = db.FailChallenges(image.Wallet, db.CHALLENGE_PURPOSE_IMAGE_DELETE)
+		return keyring.Proof{}, fmt.Errorf("invalid signature")
+	}
+	if err := db.UseChallenge(*signed); err != nil {
+		return keyring.Proof{}, err
+	}
+
+	return keyring.Proof{
+		Message:   message(signed.Value),
+		Signature: body.Signature,
+		SignerKey: signer,
+	}, nil
+}
+
+// DeleteImage removes an image of the wallet and tells the group, so peers
+// stop serving it as well. The delete statement has to be signed by the
+// wallet, a token alone can't delete images across the group.
+func DeleteImage(w http.ResponseWriter, r *http.Request) {
+	storedUser := r.Context().Value(CONTEXT_USER_OBJECT_KEY).(db.UserKey)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body DeleteImageBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	image, err := db.GetImage(body.Id, body.Post, storedUser.WalletID)
+	if err != nil {
+		if err == db.ErrImageNotFound {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Failed to delete image", http.StatusInternalServerError)
+		return
+	}
+
+	proof, err := verifyDelete(image, body)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tombstone, err := distributed.SignImageTombstone(image, proof)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to delete image", http.StatusInternalServerError)
+		return
+	}
+	if err := db.DeleteImage(tombstone); err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to delete image", http.StatusInternalServerError)
+		return
+	}
+
+	if err := distributed.PublishImageTombstone(tombstone); err != nil {
+		fmt.Println(err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
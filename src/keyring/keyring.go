@@ -0,0 +1,270 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const (
+	KEY_CHANGE_DOMAIN   = "veracy.server key change"
+	IMAGE_DELETE_DOMAIN = "veracy.server image delete"
+	ACTION_ADD          = "add"
+	ACTION_REVOKE       = "revoke"
+)
+
+// Proof is a signed key change or image delete statement. SignerKey is the public JWK that
+// made the signature, either the wallet key itself or another device key of
+// the wallet.
+type Proof struct {
+	Message   string `json:"message"`
+	Signature string `json:"signature"`
+	SignerKey string `json:"signerKey"`
+}
+
+type Entry struct {
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Proof *Proof `json:"proof,omitempty"`
+}
+
+// Revocation is the signed statement that revoked a key of the wallet, Key is
+// the thumbprint of the revoked key.
+type Revocation struct {
+	Key   string `json:"key"`
+	Proof Proof  `json:"proof"`
+}
+
+// Bundle is the set of active keys of a wallet as exchanged between nodes,
+// along with the revocations that keep older bundles from bringing revoked
+// keys back.
+type Bundle struct {
+	Keys    []Entry      `json:"keys"`
+	Revoked []Revocation `json:"revoked,omitempty"`
+}
+
+func ParsePublicKey(key string) (*rsa.PublicKey, error) {
+	publicJWK, err := jwk.ParseKey([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	var rsaPublicKey rsa.PublicKey
+	if err := publicJWK.Raw(&rsaPublicKey); err != nil {
+		return nil, err
+	}
+	return &rsaPublicKey, nil
+}
+
+// Thumbprint identifies a public JWK independent of its serialization.
+func Thumbprint(key string) (string, error) {
+	publicJWK, err := jwk.ParseKey([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	thumbprint, err := publicJWK.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+func DecodeSignature(signature string) ([]byte, error) {
+	signature = strings.TrimRight(signature, "=")
+	if sig, err := base64.RawURLEncoding.DecodeString(signature); err == nil {
+		return sig, nil
+	}
+	return base64.RawStdEncoding.DecodeString(signature)
+}
+
+// VerifySignature checks an RSA-PSS signature as made by Arweave wallets.
+func VerifySignature(rsaPublicKey *rsa.PublicKey, message []byte, signature []byte) error {
+	hashed := sha256.Sum256(message)
+	return rsa.VerifyPSS(rsaPublicKey, crypto.SHA256, hashed[:], signature, &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthAuto,
+	})
+}
+
+// ChangeMessage builds the statement a wallet signs to add or revoke a key.
+// The subject is the thumbprint of the added or revoked key.
+func ChangeMessage(wallet string, action string, subject string, nonce string) string {
+	return fmt.Sprintf("%s\nWallet: %s\nAction: %s\nKey: %s\nNonce: %s", KEY_CHANGE_DOMAIN, wallet, action, subject, nonce)
+}
+
+// DeleteMessage builds the statement a wallet signs to delete one of its
+// images. The hash binds it to the content, so it can't delete a later
+// upload under the same id.
+func DeleteMessage(wallet string, post string, id int64, hash string, nonce string) string {
+	return fmt.Sprintf("%s\nWallet: %s\nPost: %s\nImage: %d\nHash: %s\nNonce: %s", IMAGE_DELETE_DOMAIN, wallet, post, id, hash, nonce)
+}
+
+// ParseStatement returns the fields of a signed statement of the domain.
+func ParseStatement(domain string, message string) (map[string]string, error) {
+	lines := strings.Split(message, "\n")
+	if len(lines) == 0 || lines[0] != domain {
+		return nil, fmt.Errorf("not a %s statement", domain)
+	}
+	fields := map[string]string{}
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ": ")
+		if !found {
+			return nil, fmt.Errorf("malformed %s statement", domain)
+		}
+		fields[name] = value
+	}
+	return fields, nil
+}
+
+// Verify checks the signature of the proof and returns the thumbprint of the
+// signer key.
+func (proof *Proof) Verify() (string, error) {
+	signerKey, err := ParsePublicKey(proof.SignerKey)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse signer key: %w", err)
+	}
+	signature, err := DecodeSignature(proof.Signature)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	if err := VerifySignature(signerKey, []byte(proof.Message), signature); err != nil {
+		return "", fmt.Errorf("invalid signature: %w", err)
+	}
+	return Thumbprint(proof.SignerKey)
+}
+
+// VerifyBundle parses the keys of a wallet received from a peer. The wallet
+// key is accepted if it matches the address, every other key needs a proof
+// signed by an already accepted key or by the wallet key. Keys revoked in
+// the bundle or listed in revoked, the thumbprints of revocations seen
+// before, are dropped together with the keys only they vouched for. A plain
+// JWK, as sent by older nodes, is accepted as the wallet key.
+func VerifyBundle(wallet string, data []byte, revoked []string) (Bundle, error) {
+	revokedKeys := map[string]bool{}
+	for _, thumbprint := range revoked {
+		revokedKeys[thumbprint] = true
+	}
+
+	var bundle Bundle
+	if err := json.Unmarshal(data, &bundle); err != nil || len(bundle.Keys) == 0 {
+		if err := arweave.VerifyKeyOwner(wallet, string(data)); err != nil {
+			return Bundle{}, err
+		}
+		if thumbprint, err := Thumbprint(string(data)); err != nil || revokedKeys[thumbprint] {
+			return Bundle{}, fmt.Errorf("no verifiable key for wallet %s", wallet)
+		}
+		return Bundle{Keys: []Entry{{Key: string(data)}}}, nil
+	}
+
+	// Revocations may be signed by any key of the wallet, including the ones
+	// revoked by the same bundle.
+	_, signers, err := acceptKeys(wallet, bundle.Keys, revokedKeys)
+	if err != nil {
+		return Bundle{}, err
+	}
+	verified := Bundle{}
+	for _, revocation := range bundle.Revoked {
+		if verifyRevocation(wallet, revocation, signers) != nil {
+			continue
+		}
+		revokedKeys[revocation.Key] = true
+		verified.Revoked = append(verified.Revoked, revocation)
+	}
+
+	verified.Keys, _, err = acceptKeys(wallet, bundle.Keys, revokedKeys)
+	if err != nil {
+		return Bundle{}, err
+	}
+	if len(verified.Keys) == 0 {
+		return Bundle{}, fmt.Errorf("no verifiable key for wallet %s", wallet)
+	}
+	return verified, nil
+}
+
+// acceptKeys returns the entries that chain up to the wallet key through
+// keys that aren't revoked, along with their thumbprints.
+func acceptKeys(wallet string, keys []Entry, revoked map[string]bool) ([]Entry, map[string]bool, error) {
+	accepted := map[string]bool{}
+	var entries []Entry
+	pending := []Entry{}
+	for _, entry := range keys {
+		thumbprint, err := Thumbprint(entry.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if revoked[thumbprint] {
+			continue
+		}
+		if arweave.VerifyKeyOwner(wallet, entry.Key) == nil {
+			accepted[thumbprint] = true
+			entries = append(entries, entry)
+			continue
+		}
+		pending = append(pending, entry)
+	}
+
+	for progress := true; progress && len(pending) > 0; {
+		progress = false
+		remaining := []Entry{}
+		for _, entry := range pending {
+			if verifyEntryProof(wallet, entry, accepted) != nil {
+				remaining = append(remaining, entry)
+				continue
+			}
+			thumbprint, _ := Thumbprint(entry.Key)
+			accepted[thumbprint] = true
+			entries = append(entries, entry)
+			progress = true
+		}
+		pending = remaining
+	}
+	return entries, accepted, nil
+}
+
+// verifySigner checks the signature of a key change proof, made by an
+// accepted key or by the wallet key, and returns its statement fields.
+func verifySigner(wallet string, proof Proof, accepted map[string]bool) (map[string]string, error) {
+	signer, err := proof.Verify()
+	if err != nil {
+		return nil, err
+	}
+	if !accepted[signer] && arweave.VerifyKeyOwner(wallet, proof.SignerKey) != nil {
+		return nil, fmt.Errorf("signer is not a key of the wallet")
+	}
+	return ParseStatement(KEY_CHANGE_DOMAIN, proof.Message)
+}
+
+func verifyEntryProof(wallet string, entry Entry, accepted map[string]bool) error {
+	if entry.Proof == nil {
+		return fmt.Errorf("missing proof")
+	}
+	fields, err := verifySigner(wallet, *entry.Proof, accepted)
+	if err != nil {
+		return err
+	}
+	thumbprint, err := Thumbprint(entry.Key)
+	if err != nil {
+		return err
+	}
+	if fields["Wallet"] != wallet || fields["Action"] != ACTION_ADD || fields["Key"] != thumbprint {
+		return fmt.Errorf("proof does not match key")
+	}
+	return nil
+}
+
+func verifyRevocation(wallet string, revocation Revocation, accepted map[string]bool) error {
+	fields, err := verifySigner(wallet, revocation.Proof, accepted)
+	if err != nil {
+		return err
+	}
+	if fields["Wallet"] != wallet || fields["Action"] != ACTION_REVOKE || fields["Key"] != revocation.Key {
+		return fmt.Errorf("proof does not match revocation")
+	}
+	return nil
+}
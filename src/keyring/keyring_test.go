@@ -0,0 +1,208 @@
+package keyring
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+type testKey struct {
+	private    *rsa.PrivateKey
+	jwk        string
+	thumbprint string
+}
+
+func newTestKey(t *testing.T) testKey {
+	t.Helper()
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicJWK, err := jwk.FromRaw(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(publicJWK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint, err := Thumbprint(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKey{private: private, jwk: string(data), thumbprint: thumbprint}
+}
+
+func (k testKey) address(t *testing.T) string {
+	address, err := arweave.AddressFromKey(k.jwk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+func (k testKey) sign(t *testing.T, message string) Proof {
+	t.Helper()
+	hashed := sha256.Sum256([]byte(message))
+	signature, err := rsa.SignPSS(rand.Reader, k.private, crypto.SHA256, hashed[:], &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthAuto,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Proof{
+		Message:   message,
+		Signature: base64.RawURLEncoding.EncodeToString(signature),
+		SignerKey: k.jwk,
+	}
+}
+
+func (k testKey) add(t *testing.T, wallet string, key testKey) Entry {
+	proof := k.sign(t, ChangeMessage(wallet, ACTION_ADD, key.thumbprint, "nonce"))
+	return Entry{Key: key.jwk, Proof: &proof}
+}
+
+func (k testKey) revoke(t *testing.T, wallet string, key testKey) Revocation {
+	return Revocation{Key: key.thumbprint, Proof: k.sign(t, ChangeMessage(wallet, ACTION_REVOKE, key.thumbprint, "nonce"))}
+}
+
+func encodeBundle(t *testing.T, bundle Bundle) []byte {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func thumbprints(entries []Entry) map[string]bool {
+	keys := map[string]bool{}
+	for _, entry := range entries {
+		thumbprint, _ := Thumbprint(entry.Key)
+		keys[thumbprint] = true
+	}
+	return keys
+}
+
+func TestVerifyBundle(t *testing.T) {
+	walletKey, phone, laptop, outsider := newTestKey(t), newTestKey(t), newTestKey(t), newTestKey(t)
+	wallet := walletKey.address(t)
+
+	t.Run("plain wallet key", func(t *testing.T) {
+		bundle, err := VerifyBundle(wallet, []byte(walletKey.jwk), nil)
+		if err != nil || len(bundle.Keys) != 1 {
+			t.Fatalf("bundle %+v, error %v", bundle, err)
+		}
+		if _, err := VerifyBundle(wallet, []byte(outsider.jwk), nil); err == nil {
+			t.Error("accepted the key of another wallet")
+		}
+		if _, err := VerifyBundle(wallet, []byte(walletKey.jwk), []string{walletKey.thumbprint}); err == nil {
+			t.Error("accepted a revoked wallet key")
+		}
+	})
+
+	t.Run("chained keys", func(t *testing.T) {
+		// The laptop was added from the phone, and is listed first.
+		data := encodeBundle(t, Bundle{Keys: []Entry{
+			phone.add(t, wallet, laptop),
+			{Key: walletKey.jwk},
+			walletKey.add(t, wallet, phone),
+		}})
+		bundle, err := VerifyBundle(wallet, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := thumbprints(bundle.Keys); len(keys) != 3 || !keys[laptop.thumbprint] {
+			t.Errorf("accepted %v, want all three keys", keys)
+		}
+	})
+
+	t.Run("unproven keys", func(t *testing.T) {
+		otherWallet := outsider.address(t)
+		wrongKey := walletKey.add(t, wallet, phone)
+		wrongKey.Key = laptop.jwk
+		data := encodeBundle(t, Bundle{Keys: []Entry{
+			{Key: walletKey.jwk},
+			{Key: phone.jwk},
+			wrongKey,
+			outsider.add(t, wallet, outsider),
+			walletKey.add(t, otherWallet, outsider),
+		}})
+		bundle, err := VerifyBundle(wallet, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := thumbprints(bundle.Keys); len(keys) != 1 || !keys[walletKey.thumbprint] {
+			t.Errorf("accepted %v, want the wallet key only", keys)
+		}
+		if _, err := VerifyBundle(wallet, encodeBundle(t, Bundle{Keys: []Entry{{Key: phone.jwk}}}), nil); err == nil {
+			t.Error("accepted a bundle without a verifiable key")
+		}
+	})
+
+	keys := []Entry{
+		{Key: walletKey.jwk},
+		walletKey.add(t, wallet, phone),
+		phone.add(t, wallet, laptop),
+	}
+
+	t.Run("revoked in the bundle", func(t *testing.T) {
+		data := encodeBundle(t, Bundle{Keys: keys, Revoked: []Revocation{walletKey.revoke(t, wallet, phone)}})
+		bundle, err := VerifyBundle(wallet, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The laptop was only vouched for by the revoked phone.
+		if keys := thumbprints(bundle.Keys); len(keys) != 1 || !keys[walletKey.thumbprint] {
+			t.Errorf("accepted %v, want the wallet key only", keys)
+		}
+		if len(bundle.Revoked) != 1 || bundle.Revoked[0].Key != phone.thumbprint {
+			t.Errorf("revocations %+v, want the phone", bundle.Revoked)
+		}
+	})
+
+	t.Run("revoked before", func(t *testing.T) {
+		// An older bundle still lists the phone.
+		bundle, err := VerifyBundle(wallet, encodeBundle(t, Bundle{Keys: keys}), []string{phone.thumbprint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := thumbprints(bundle.Keys); len(keys) != 1 {
+			t.Errorf("accepted %v, want the wallet key only", keys)
+		}
+	})
+
+	t.Run("revocation by a device key", func(t *testing.T) {
+		data := encodeBundle(t, Bundle{Keys: keys, Revoked: []Revocation{phone.revoke(t, wallet, laptop)}})
+		bundle, err := VerifyBundle(wallet, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys := thumbprints(bundle.Keys); len(keys) != 2 || keys[laptop.thumbprint] {
+			t.Errorf("accepted %v, want the laptop revoked", keys)
+		}
+	})
+
+	t.Run("forged revocations", func(t *testing.T) {
+		forged := walletKey.revoke(t, wallet, phone)
+		forged.Key = laptop.thumbprint
+		data := encodeBundle(t, Bundle{Keys: keys, Revoked: []Revocation{
+			outsider.revoke(t, wallet, phone),
+			walletKey.revoke(t, outsider.address(t), phone),
+			forged,
+		}})
+		bundle, err := VerifyBundle(wallet, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bundle.Keys) != 3 || len(bundle.Revoked) != 0 {
+			t.Errorf("%d keys and %d revocations, want 3 and none", len(bundle.Keys), len(bundle.Revoked))
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package media
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/url"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	MIME_JPEG = "image/jpeg"
+	MIME_PNG  = "image/png"
+	MIME_GIF  = "image/gif"
+	MIME_WEBP = "image/webp"
+
+	// SNIFF_LENGTH is enough to tell every allowed format apart.
+	SNIFF_LENGTH = 16
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrInvalidImage      = errors.New("invalid image")
+)
+
+// Sniff detects the format from the magic bytes at the start of the content
+// and returns its canonical MIME type. Only JPEG, PNG, GIF and WebP are
+// accepted.
+func Sniff(header []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return MIME_JPEG, nil
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return MIME_PNG, nil
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return MIME_GIF, nil
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return MIME_WEBP, nil
+	}
+	return "", ErrUnsupportedFormat
+}
+
+type Info struct {
+	Mime   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Inspect sniffs the format and decodes the image header for its
+// dimensions, the pixel data isn't decoded.
+func Inspect(r io.Reader) (Info, error) {
+	header := make([]byte, SNIFF_LENGTH)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return Info{}, ErrUnsupportedFormat
+	}
+	header = header[:n]
+
+	mime, err := Sniff(header)
+	if err != nil {
+		return Info{}, err
+	}
+
+	config, format, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(header), r))
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %s: %s", ErrInvalidImage, mime, err)
+	}
+	if "image/"+format != mime || config.Width <= 0 || config.Height <= 0 {
+		return Info{}, fmt.Errorf("%w: %s", ErrInvalidImage, mime)
+	}
+	if config.Width*config.Height > MAX_PIXELS {
+		return Info{}, fmt.Errorf("%w: %dx%d is too large", ErrInvalidImage, config.Width, config.Height)
+	}
+
+	return Info{
+		Mime:   mime,
+		Width:  config.Width,
+		Height: config.Height,
+	}, nil
+}
+
+func IsDataURL(s string) bool {
+	return strings.HasPrefix(s, "data:")
+}
+
+// ParseDataURL decodes the payload of a data URL, as sent by older clients.
+// The declared media type is ignored, the content is sniffed like any other
+// upload.
+func ParseDataURL(s string) ([]byte, error) {
+	if !IsDataURL(s) {
+		return nil, fmt.Errorf("not a data URL")
+	}
+	meta, payload, found := strings.Cut(strings.TrimPrefix(s, "data:"), ",")
+	if !found {
+		return nil, fmt.Errorf("invalid data URL")
+	}
+
+	if strings.HasSuffix(meta, ";base64") {
+		payload = strings.TrimRight(strings.TrimSpace(payload), "=")
+		data, err := base64.RawStdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data URL payload: %w", err)
+		}
+		return data, nil
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URL payload: %w", err)
+	}
+	return []byte(data), nil
+}
@@ -0,0 +1,97 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	PRESET_THUMB = "thumb"
+	PRESET_FEED  = "feed"
+	PRESET_FULL  = "full"
+
+	JPEG_QUALITY = 85
+	// MAX_PIXELS keeps decoding bounded, the header is checked before any
+	// pixel data is touched.
+	MAX_PIXELS = 40_000_000
+)
+
+// VariantWidths are the only widths variants are generated at, requested
+// widths are rounded up to the next one so arbitrary values can't fill the
+// blob store.
+var VariantWidths = []int{160, 320, 640, 1000}
+
+var presets = map[string]int{
+	PRESET_THUMB: 160,
+	PRESET_FEED:  640,
+	PRESET_FULL:  0,
+}
+
+// ParseWidth turns a w parameter, either a preset name or a width in pixels,
+// into a variant width. Zero means the original.
+func ParseWidth(w string) (int, error) {
+	if w == "" {
+		return 0, nil
+	}
+	if width, ok := presets[w]; ok {
+		return width, nil
+	}
+	width, err := strconv.Atoi(w)
+	if err != nil || width <= 0 {
+		return 0, fmt.Errorf("invalid width %q", w)
+	}
+	for _, variantWidth := range VariantWidths {
+		if width <= variantWidth {
+			return variantWidth, nil
+		}
+	}
+	return 0, nil
+}
+
+// CanResize tells whether a variant narrower than the original can be made.
+// GIFs are always served as they are, to keep their animation.
+func CanResize(info Info, width int) bool {
+	return width > 0 && width < info.Width && info.Mime != MIME_GIF && info.Mime != ""
+}
+
+// Resize scales the image down to the width, keeping its aspect ratio.
+// JPEGs stay JPEGs, everything else is encoded as PNG since there is no WebP
+// encoder and the alpha channel has to be kept.
+func Resize(data []byte, width int) ([]byte, Info, error) {
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		return nil, Info{}, err
+	}
+	if !CanResize(info, width) {
+		return nil, Info{}, fmt.Errorf("can't resize %s from %d to %d", info.Mime, info.Width, width)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+
+	height := max((info.Height*width+info.Width/2)/info.Width, 1)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+	var out bytes.Buffer
+	variant := Info{Width: width, Height: height}
+	if info.Mime == MIME_JPEG {
+		variant.Mime = MIME_JPEG
+		err = jpeg.Encode(&out, dst, &jpeg.Options{Quality: JPEG_QUALITY})
+	} else {
+		variant.Mime = MIME_PNG
+		err = png.Encode(&out, dst)
+	}
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("failed to encode variant: %w", err)
+	}
+	return out.Bytes(), variant, nil
+}
@@ -0,0 +1,545 @@
+package media
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+)
+
+const (
+	STRIP_EXIF      = "EXIF"
+	STRIP_XMP       = "XMP"
+	STRIP_IPTC      = "IPTC"
+	STRIP_COMMENT   = "comment"
+	STRIP_TEXT      = "text"
+	STRIP_TIMESTAMP = "timestamp"
+	STRIP_TRAILING  = "trailing data"
+
+	ROTATED_JPEG_QUALITY = 92
+
+	exifOrientationTag = 0x0112
+	exifMakeTag        = 0x010F
+	exifModelTag       = 0x0110
+	exifGPSTag         = 0x8825
+)
+
+// StripReport tells what was removed from an upload.
+type StripReport struct {
+	Removed      []string `json:"removed"`
+	RemovedBytes int64    `json:"removedBytes"`
+	GPS          bool     `json:"gps"`
+	Device       bool     `json:"device"`
+	Orientation  int      `json:"orientation,omitempty"`
+	Rotated      bool     `json:"rotated"`
+}
+
+func (report *StripReport) remove(kind string, size int) {
+	if !slices.Contains(report.Removed, kind) {
+		report.Removed = append(report.Removed, kind)
+	}
+	report.RemovedBytes += int64(size)
+}
+
+func (report *StripReport) readExif(tiff []byte) {
+	orientation, gps, device := parseExif(tiff)
+	report.Orientation = orientation
+	report.GPS = report.GPS || gps
+	report.Device = report.Device || device
+}
+
+func CanStrip(mime string) bool {
+	return mime == MIME_JPEG || mime == MIME_PNG
+}
+
+// StripMetadata copies the image to dst without its EXIF, XMP and IPTC
+// metadata, comments and text chunks. The pixel data is copied as it is,
+// unless the EXIF orientation asks for a rotation: then the image is decoded,
+// rotated and encoded again, since the orientation is removed with the rest
+// of the EXIF data.
+func StripMetadata(src io.ReadSeeker, dst io.Writer, mime string) (StripReport, error) {
+	switch mime {
+	case MIME_JPEG:
+		return stripJPEG(src, dst)
+	case MIME_PNG:
+		return stripPNG(src, dst)
+	}
+	return StripReport{}, ErrUnsupportedFormat
+}
+
+var (
+	jpegExifPrefix         = []byte("Exif\x00\x00")
+	jpegXMPPrefix          = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegXMPExtensionPrefix = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	jpegIPTCPrefix         = []byte("Photoshop 3.0\x00")
+	jpegICCPrefix          = []byte("ICC_PROFILE\x00")
+)
+
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP0 = 0xE0
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+	jpegAPPD = 0xED
+	jpegAPPE = 0xEE
+	jpegAPPF = 0xEF
+	jpegCOM  = 0xFE
+)
+
+// jpegSegmentKind names the metadata in an APPn or COM segment, an empty
+// name means the segment is kept.
+func jpegSegmentKind(marker byte, payload []byte) string {
+	switch {
+	case marker == jpegAPP1 && bytes.HasPrefix(payload, jpegExifPrefix):
+		return STRIP_EXIF
+	case marker == jpegAPP1 && (bytes.HasPrefix(payload, jpegXMPPrefix) || bytes.HasPrefix(payload, jpegXMPExtensionPrefix)):
+		return STRIP_XMP
+	case marker == jpegAPPD && bytes.HasPrefix(payload, jpegIPTCPrefix):
+		return STRIP_IPTC
+	case marker == jpegAPP2 && bytes.HasPrefix(payload, jpegICCPrefix):
+		return ""
+	case marker == jpegAPP0 || marker == jpegAPPE:
+		// JFIF and Adobe segments describe how to decode the image.
+		return ""
+	case marker == jpegCOM:
+		return STRIP_COMMENT
+	case marker >= jpegAPP0 && marker <= jpegAPPF:
+		return fmt.Sprintf("APP%d", marker-jpegAPP0)
+	}
+	return ""
+}
+
+type jpegSegment struct {
+	marker  byte
+	payload []byte
+}
+
+func (segment jpegSegment) bytes() []byte {
+	out := []byte{0xFF, segment.marker, 0, 0}
+	binary.BigEndian.PutUint16(out[2:], uint16(len(segment.payload)+2))
+	return append(out, segment.payload...)
+}
+
+func stripJPEG(src io.ReadSeeker, dst io.Writer) (StripReport, error) {
+	report := StripReport{Removed: []string{}}
+	reader := bufio.NewReader(src)
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(reader, soi); err != nil || soi[0] != 0xFF || soi[1] != jpegSOI {
+		return report, fmt.Errorf("%w: missing JPEG start", ErrInvalidImage)
+	}
+
+	var kept []jpegSegment
+	for {
+		marker, err := readJPEGMarker(reader)
+		if err != nil {
+			return report, err
+		}
+		if marker == jpegSOS {
+			break
+		}
+		if marker == jpegEOI || marker == jpegSOI {
+			return report, fmt.Errorf("%w: no JPEG scan", ErrInvalidImage)
+		}
+
+		segment, err := readJPEGSegment(reader, marker)
+		if err != nil {
+			return report, err
+		}
+
+		kind := jpegSegmentKind(marker, segment.payload)
+		if kind == STRIP_EXIF {
+			report.readExif(segment.payload[len(jpegExifPrefix):])
+		}
+		if kind != "" {
+			report.remove(kind, len(segment.payload)+4)
+			continue
+		}
+		kept = append(kept, segment)
+	}
+
+	if needsRotation(report.Orientation) {
+		var icc [][]byte
+		for _, segment := range kept {
+			if segment.marker == jpegAPP2 {
+				icc = append(icc, segment.bytes())
+			}
+		}
+		err := rotateJPEG(src, dst, &report, icc)
+		return report, err
+	}
+
+	out := bufio.NewWriter(dst)
+	out.Write([]byte{0xFF, jpegSOI})
+	for _, segment := range kept {
+		out.Write(segment.bytes())
+	}
+
+	// Copy the scans and the tables between them up to the end of the image.
+	// Anything after it, like the extra pictures some phones append, is
+	// dropped.
+	marker := byte(jpegSOS)
+	for {
+		out.Write([]byte{0xFF, marker})
+		if marker == jpegEOI {
+			break
+		}
+		segment, err := readJPEGSegment(reader, marker)
+		if err != nil {
+			return report, err
+		}
+		out.Write(segment.bytes()[2:])
+		if marker == jpegSOS {
+			marker, err = copyJPEGScan(reader, out)
+		} else {
+			marker, err = readJPEGMarker(reader)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	trailing, _ := io.Copy(io.Discard, reader)
+	if trailing > 0 {
+		report.remove(STRIP_TRAILING, int(trailing))
+	}
+
+	return report, out.Flush()
+}
+
+func readJPEGSegment(reader *bufio.Reader, marker byte) (jpegSegment, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return jpegSegment{}, fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+	size := int(binary.BigEndian.Uint16(length))
+	if size < 2 {
+		return jpegSegment{}, fmt.Errorf("%w: bad JPEG segment length", ErrInvalidImage)
+	}
+	payload := make([]byte, size-2)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return jpegSegment{}, fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+	return jpegSegment{marker: marker, payload: payload}, nil
+}
+
+// copyJPEGScan copies entropy coded data up to the next marker and returns
+// it. Stuffed zero bytes and restart markers belong to the scan.
+func copyJPEGScan(reader *bufio.Reader, out *bufio.Writer) (byte, error) {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("%w: missing JPEG end", ErrInvalidImage)
+		}
+		if b != 0xFF {
+			out.WriteByte(b)
+			continue
+		}
+		next, err := reader.ReadByte()
+		for err == nil && next == 0xFF {
+			next, err = reader.ReadByte()
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: missing JPEG end", ErrInvalidImage)
+		}
+		if next == 0x00 || next >= 0xD0 && next <= 0xD7 {
+			out.Write([]byte{0xFF, next})
+			continue
+		}
+		return next, nil
+	}
+}
+
+func readJPEGMarker(reader *bufio.Reader) (byte, error) {
+	b, err := reader.ReadByte()
+	if err != nil || b != 0xFF {
+		return 0, fmt.Errorf("%w: bad JPEG marker", ErrInvalidImage)
+	}
+	for b == 0xFF {
+		if b, err = reader.ReadByte(); err != nil {
+			return 0, fmt.Errorf("%w: bad JPEG marker", ErrInvalidImage)
+		}
+	}
+	return b, nil
+}
+
+func rotateJPEG(src io.ReadSeeker, dst io.Writer, report *StripReport, icc [][]byte) error {
+	img, err := decodeFromStart(src)
+	if err != nil {
+		return err
+	}
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, orient(img, report.Orientation), &jpeg.Options{Quality: ROTATED_JPEG_QUALITY})
+	if err != nil {
+		return fmt.Errorf("failed to encode rotated image: %w", err)
+	}
+	report.Rotated = true
+
+	// Keep the color profile, right after the start of the image.
+	data := encoded.Bytes()
+	if _, err := dst.Write(data[:2]); err != nil {
+		return err
+	}
+	for _, segment := range icc {
+		if _, err := dst.Write(segment); err != nil {
+			return err
+		}
+	}
+	_, err = dst.Write(data[2:])
+	return err
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngKeptChunks are the ancillary chunks that affect how the image looks,
+// every other ancillary chunk is removed.
+var pngKeptChunks = []string{
+	"tRNS", "gAMA", "cHRM", "sRGB", "iCCP", "sBIT", "bKGD", "hIST", "pHYs", "sPLT",
+	"acTL", "fcTL", "fdAT",
+}
+
+// pngColorChunks are kept when the image is encoded again after a rotation.
+var pngColorChunks = []string{"gAMA", "cHRM", "sRGB", "iCCP", "sBIT"}
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+func (chunk pngChunk) bytes() []byte {
+	out := make([]byte, 8, 12+len(chunk.data))
+	binary.BigEndian.PutUint32(out, uint32(len(chunk.data)))
+	copy(out[4:], chunk.kind)
+	out = append(out, chunk.data...)
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunk.kind))
+	crc.Write(chunk.data)
+	return binary.BigEndian.AppendUint32(out, crc.Sum32())
+}
+
+func pngChunkKind(chunk pngChunk) string {
+	if chunk.kind[0] >= 'A' && chunk.kind[0] <= 'Z' || slices.Contains(pngKeptChunks, chunk.kind) {
+		return ""
+	}
+	switch chunk.kind {
+	case "eXIf":
+		return STRIP_EXIF
+	case "iTXt":
+		if bytes.HasPrefix(chunk.data, []byte("XML:com.adobe.xmp\x00")) {
+			return STRIP_XMP
+		}
+		return STRIP_TEXT
+	case "tEXt", "zTXt":
+		return STRIP_TEXT
+	case "tIME":
+		return STRIP_TIMESTAMP
+	}
+	return chunk.kind
+}
+
+func stripPNG(src io.ReadSeeker, dst io.Writer) (StripReport, error) {
+	report := StripReport{Removed: []string{}}
+	reader := bufio.NewReader(src)
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(reader, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return report, fmt.Errorf("%w: missing PNG signature", ErrInvalidImage)
+	}
+
+	out := bufio.NewWriter(dst)
+	var pending []pngChunk
+	started := false
+	for {
+		chunk, err := readPNGChunk(reader)
+		if err != nil {
+			return report, err
+		}
+
+		if kind := pngChunkKind(chunk); kind != "" {
+			if kind == STRIP_EXIF {
+				report.readExif(chunk.data)
+			}
+			report.remove(kind, len(chunk.data)+12)
+		} else if started {
+			out.Write(chunk.bytes())
+		} else {
+			pending = append(pending, chunk)
+		}
+
+		// The orientation is known once the image data starts.
+		if !started && (chunk.kind == "IDAT" || chunk.kind == "IEND") {
+			started = true
+			if needsRotation(report.Orientation) {
+				err := rotatePNG(src, dst, &report, pending)
+				return report, err
+			}
+			out.Write(pngSignature)
+			for _, kept := range pending {
+				out.Write(kept.bytes())
+			}
+		}
+		if chunk.kind == "IEND" {
+			break
+		}
+	}
+	trailing, _ := io.Copy(io.Discard, reader)
+	if trailing > 0 {
+		report.remove(STRIP_TRAILING, int(trailing))
+	}
+
+	return report, out.Flush()
+}
+
+func readPNGChunk(reader *bufio.Reader) (pngChunk, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return pngChunk{}, fmt.Errorf("%w: missing PNG end", ErrInvalidImage)
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > 1<<31-1 {
+		return pngChunk{}, fmt.Errorf("%w: bad PNG chunk length", ErrInvalidImage)
+	}
+	// The length comes from the file, the buffer only grows with the data
+	// that is actually there.
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, reader, int64(length)+4); err != nil {
+		return pngChunk{}, fmt.Errorf("%w: truncated PNG chunk", ErrInvalidImage)
+	}
+	return pngChunk{kind: string(header[4:8]), data: data.Bytes()[:length]}, nil
+}
+
+func rotatePNG(src io.ReadSeeker, dst io.Writer, report *StripReport, pending []pngChunk) error {
+	img, err := decodeFromStart(src)
+	if err != nil {
+		return err
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, orient(img, report.Orientation)); err != nil {
+		return fmt.Errorf("failed to encode rotated image: %w", err)
+	}
+	report.Rotated = true
+
+	// Keep the color information, right after the header chunk.
+	data := encoded.Bytes()
+	headerEnd := len(pngSignature) + 25
+	if _, err := dst.Write(data[:headerEnd]); err != nil {
+		return err
+	}
+	for _, chunk := range pending {
+		if slices.Contains(pngColorChunks, chunk.kind) {
+			if _, err := dst.Write(chunk.bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = dst.Write(data[headerEnd:])
+	return err
+}
+
+func decodeFromStart(src io.ReadSeeker) (image.Image, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+	return img, nil
+}
+
+func needsRotation(orientation int) bool {
+	return orientation >= 2 && orientation <= 8
+}
+
+// orient applies an EXIF orientation, so the pixels are stored the way the
+// image is meant to be seen. Source rows are converted one at a time, the
+// rotated image is the only full size buffer.
+func orient(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	row := image.NewRGBA(image.Rect(0, 0, w, 1))
+
+	for sy := 0; sy < h; sy++ {
+		draw.Draw(row, row.Rect, img, image.Pt(bounds.Min.X, bounds.Min.Y+sy), draw.Src)
+		for sx := 0; sx < w; sx++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-sx, sy
+			case 3:
+				dx, dy = w-1-sx, h-1-sy
+			case 4:
+				dx, dy = sx, h-1-sy
+			case 5:
+				dx, dy = sy, sx
+			case 6:
+				dx, dy = h-1-sy, sx
+			case 7:
+				dx, dy = h-1-sy, w-1-sx
+			case 8:
+				dx, dy = sy, w-1-sx
+			default:
+				dx, dy = sx, sy
+			}
+			offset := dst.PixOffset(dx, dy)
+			copy(dst.Pix[offset:offset+4], row.Pix[sx*4:sx*4+4])
+		}
+	}
+	return dst
+}
+
+// parseExif reads the orientation from the first IFD of the TIFF structure
+// inside an EXIF block, and whether it holds GPS or device information.
+func parseExif(tiff []byte) (int, bool, bool) {
+	if len(tiff) < 8 {
+		return 0, false, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false, false
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0, false, false
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0, false, false
+	}
+	count := int(order.Uint16(tiff[offset:]))
+
+	orientation, gps, device := 0, false, false
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		switch order.Uint16(tiff[entry:]) {
+		case exifOrientationTag:
+			orientation = int(order.Uint16(tiff[entry+8:]))
+		case exifGPSTag:
+			gps = true
+		case exifMakeTag, exifModelTag:
+			device = true
+		}
+	}
+	return orientation, gps, device
+}
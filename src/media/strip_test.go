@@ -0,0 +1,211 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+// exifBlock builds a big endian TIFF structure with an orientation and a GPS
+// pointer in its first IFD.
+func exifBlock(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	entry := func(tag uint16, kind uint16, value uint32) {
+		tiff = binary.BigEndian.AppendUint16(tiff, tag)
+		tiff = binary.BigEndian.AppendUint16(tiff, kind)
+		tiff = binary.BigEndian.AppendUint32(tiff, 1)
+		tiff = binary.BigEndian.AppendUint32(tiff, value)
+	}
+	entry(exifOrientationTag, 3, uint32(orientation)<<16)
+	entry(exifGPSTag, 4, 0)
+	return binary.BigEndian.AppendUint32(tiff, 0)
+}
+
+// testImage has a distinct color in every pixel, so rotations can be told
+// apart.
+func testImage(w int, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 40), uint8(y * 40), 200, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image, extra ...pngChunk) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	// The extra chunks go right after the header chunk.
+	data := encoded.Bytes()
+	headerEnd := len(pngSignature) + 25
+	out := append([]byte{}, data[:headerEnd]...)
+	for _, chunk := range extra {
+		out = append(out, chunk.bytes()...)
+	}
+	return append(out, data[headerEnd:]...)
+}
+
+func TestStripPNG(t *testing.T) {
+	src := encodePNG(t, testImage(4, 3),
+		pngChunk{kind: "tEXt", data: []byte("Author\x00someone")},
+		pngChunk{kind: "tIME", data: make([]byte, 7)},
+		pngChunk{kind: "gAMA", data: []byte{0, 1, 0x86, 0xa0}},
+	)
+
+	var dst bytes.Buffer
+	report, err := StripMetadata(bytes.NewReader(src), &dst, MIME_PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(report.Removed, STRIP_TEXT) || !slices.Contains(report.Removed, STRIP_TIMESTAMP) {
+		t.Errorf("removed %v, want text and timestamp", report.Removed)
+	}
+	if bytes.Contains(dst.Bytes(), []byte("someone")) {
+		t.Error("text chunk was kept")
+	}
+	if !bytes.Contains(dst.Bytes(), []byte("gAMA")) {
+		t.Error("gamma chunk was removed")
+	}
+	if _, err := png.Decode(&dst); err != nil {
+		t.Errorf("stripped PNG doesn't decode: %v", err)
+	}
+}
+
+func TestStripPNGRotates(t *testing.T) {
+	src := encodePNG(t, testImage(4, 3), pngChunk{kind: "eXIf", data: exifBlock(6)})
+
+	var dst bytes.Buffer
+	report, err := StripMetadata(bytes.NewReader(src), &dst, MIME_PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Rotated || report.Orientation != 6 || !report.GPS {
+		t.Errorf("report %+v, want rotated orientation 6 with GPS", report)
+	}
+	img, err := png.Decode(&dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(3, 4) {
+		t.Errorf("rotated size %v, want 3x4", size)
+	}
+}
+
+func TestStripPNGChunkLength(t *testing.T) {
+	// A chunk claiming a GiB in a file of a few bytes.
+	src := append([]byte{}, pngSignature...)
+	src = binary.BigEndian.AppendUint32(src, 1<<30)
+	src = append(src, "tEXt"...)
+	src = append(src, "short"...)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := StripMetadata(bytes.NewReader(src), &bytes.Buffer{}, MIME_PNG)
+	runtime.ReadMemStats(&after)
+
+	if !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("error %v, want ErrInvalidImage", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("%d bytes allocated for a truncated chunk", allocated)
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(4, 3), nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append(append([]byte{}, jpegExifPrefix...), exifBlock(1)...)
+	comment := []byte("taken by someone")
+	src := append([]byte{0xFF, jpegSOI}, jpegSegment{jpegAPP1, exif}.bytes()...)
+	src = append(src, jpegSegment{jpegCOM, comment}.bytes()...)
+	src = append(src, encoded.Bytes()[2:]...)
+	src = append(src, "appended picture"...)
+
+	var dst bytes.Buffer
+	report, err := StripMetadata(bytes.NewReader(src), &dst, MIME_JPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{STRIP_EXIF, STRIP_COMMENT, STRIP_TRAILING} {
+		if !slices.Contains(report.Removed, kind) {
+			t.Errorf("removed %v, want %s", report.Removed, kind)
+		}
+	}
+	if report.Rotated || !report.GPS {
+		t.Errorf("report %+v, want GPS without rotation", report)
+	}
+	if bytes.Contains(dst.Bytes(), comment) || bytes.Contains(dst.Bytes(), []byte("appended")) {
+		t.Error("metadata was kept")
+	}
+	if _, err := jpeg.Decode(&dst); err != nil {
+		t.Errorf("stripped JPEG doesn't decode: %v", err)
+	}
+}
+
+func TestStripJPEGTruncated(t *testing.T) {
+	src := []byte{0xFF, jpegSOI, 0xFF, jpegAPP1, 0xFF, 0xFF, 'E', 'x'}
+	_, err := StripMetadata(bytes.NewReader(src), &bytes.Buffer{}, MIME_JPEG)
+	if !errors.Is(err, ErrInvalidImage) {
+		t.Errorf("error %v, want ErrInvalidImage", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	src := testImage(3, 2)
+	// Where the top left source pixel ends up, and the size of the result.
+	tests := []struct {
+		orientation int
+		topLeft     image.Point
+		size        image.Point
+	}{
+		{1, image.Pt(0, 0), image.Pt(3, 2)},
+		{2, image.Pt(2, 0), image.Pt(3, 2)},
+		{3, image.Pt(2, 1), image.Pt(3, 2)},
+		{4, image.Pt(0, 1), image.Pt(3, 2)},
+		{5, image.Pt(0, 0), image.Pt(2, 3)},
+		{6, image.Pt(1, 0), image.Pt(2, 3)},
+		{7, image.Pt(1, 2), image.Pt(2, 3)},
+		{8, image.Pt(0, 2), image.Pt(2, 3)},
+	}
+	for _, test := range tests {
+		dst := orient(src, test.orientation)
+		if size := dst.Bounds().Size(); size != test.size {
+			t.Errorf("orientation %d: size %v, want %v", test.orientation, size, test.size)
+			continue
+		}
+		if got := dst.At(test.topLeft.X, test.topLeft.Y); got != src.At(0, 0) {
+			t.Errorf("orientation %d: pixel at %v is %v, want %v", test.orientation, test.topLeft, got, src.At(0, 0))
+		}
+	}
+}
+
+func TestParseExif(t *testing.T) {
+	orientation, gps, device := parseExif(exifBlock(8))
+	if orientation != 8 || !gps || device {
+		t.Errorf("parsed %d %v %v, want 8 true false", orientation, gps, device)
+	}
+
+	// A first IFD pointing past the end is ignored.
+	broken := exifBlock(8)
+	binary.BigEndian.PutUint32(broken[4:], 1000)
+	if orientation, _, _ := parseExif(broken); orientation != 0 {
+		t.Errorf("parsed orientation %d from a broken block", orientation)
+	}
+	if orientation, _, _ := parseExif([]byte("II*")); orientation != 0 {
+		t.Errorf("parsed orientation %d from a short block", orientation)
+	}
+}
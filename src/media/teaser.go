@@ -0,0 +1,80 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	TEASER_WIDTH        = 48
+	TEASER_BLUR_RADIUS  = 2
+	TEASER_BLUR_PASSES  = 3
+	TEASER_JPEG_QUALITY = 50
+	BLURHASH_COMPONENTS = 4
+)
+
+// Teaser makes a tiny, blurred JPEG preview of the image and its BlurHash.
+// Clients scale the preview up, nothing of the details survives.
+func Teaser(data []byte) ([]byte, string, error) {
+	info, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+
+	width := min(TEASER_WIDTH, info.Width)
+	height := max((info.Height*width+info.Width/2)/info.Width, 1)
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), src, src.Bounds(), draw.Src, nil)
+	for i := 0; i < TEASER_BLUR_PASSES; i++ {
+		small = boxBlur(small, TEASER_BLUR_RADIUS)
+	}
+
+	xComponents, yComponents := BLURHASH_COMPONENTS, BLURHASH_COMPONENTS-1
+	if height > width {
+		xComponents, yComponents = yComponents, xComponents
+	}
+	blurHash := BlurHash(small, xComponents, yComponents)
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, small, &jpeg.Options{Quality: TEASER_JPEG_QUALITY}); err != nil {
+		return nil, "", fmt.Errorf("failed to encode teaser: %w", err)
+	}
+	return out.Bytes(), blurHash, nil
+}
+
+// boxBlur averages every pixel with its neighbours within the radius, edge
+// pixels are repeated. A few passes approximate a gaussian blur.
+func boxBlur(src *image.RGBA, radius int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var sum [4]int
+			count := 0
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					px := min(max(x+dx, bounds.Min.X), bounds.Max.X-1)
+					py := min(max(y+dy, bounds.Min.Y), bounds.Max.Y-1)
+					offset := src.PixOffset(px, py)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(src.Pix[offset+c])
+					}
+					count++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[offset+c] = uint8(sum[c] / count)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,87 @@
+package orphans
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/arweave"
+	"github.com/acsermely/veracy.server/src/db"
+)
+
+// Report lists the uploads no post of their wallet refers to. Wallets whose
+// posts couldn't be read are listed apart, their images are kept.
+type Report struct {
+	Orphans   []db.Image `json:"orphans"`
+	Unchecked []string   `json:"unchecked"`
+}
+
+// Find looks for images uploaded more than grace ago that are not referenced
+// by any post of their wallet. The grace covers the time between the upload
+// and the post transaction showing up on Arweave.
+func Find(ctx context.Context, client *arweave.Client, grace time.Duration) (Report, error) {
+	images, err := db.GetImagesCreatedBefore(time.Now().Add(-grace))
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Orphans: []db.Image{}, Unchecked: []string{}}
+	referenced := map[string]map[string]bool{}
+	for _, image := range images {
+		refs, checked := referenced[image.Wallet]
+		if !checked {
+			refs, err = client.GetReferencedData(ctx, image.Wallet)
+			if err != nil {
+				fmt.Printf("Failed to read the posts of %s: %v\n", image.Wallet, err)
+				report.Unchecked = append(report.Unchecked, image.Wallet)
+			}
+			referenced[image.Wallet] = refs
+		}
+		if refs == nil || refs[image.FullID()] {
+			continue
+		}
+		report.Orphans = append(report.Orphans, image)
+	}
+	return report, nil
+}
+
+// Purge removes the images of the report. They leave a tombstone, so a post
+// published after all can't show a later upload under the same id.
+func Purge(report Report) int {
+	purged := 0
+	for _, image := range report.Orphans {
+		err := db.DeleteImage(db.ImageTombstone{
+			Wallet:  image.Wallet,
+			Post:    image.Post,
+			ImageID: image.ID,
+			Hash:    image.Hash,
+		})
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		purged++
+	}
+	return purged
+}
+
+// Reconcile purges orphaned uploads periodically. It is meant to run in its
+// own goroutine for the lifetime of the server.
+func Reconcile(client *arweave.Client, interval time.Duration, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report, err := Find(context.Background(), client, grace)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, image := range report.Orphans {
+			fmt.Printf("Orphaned upload %s (%d bytes)\n", image.FullID(), image.Size)
+		}
+		if len(report.Orphans) > 0 {
+			fmt.Printf("Purged %d of %d orphaned uploads\n", Purge(report), len(report.Orphans))
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/acsermely/veracy.server/src/db"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+const (
+	KEY_ROTATION_INTERVAL = 7 * 24 * time.Hour
+	// Rotated keys stay valid for the longest token lifetime, so tokens
+	// issued right before a rotation can still be verified.
+	KEY_RETIREMENT_DELAY = 24 * time.Hour
+	// Keys of peers are forgotten if they are not announced again.
+	PEER_KEY_TTL = time.Hour
+	KID_BYTES    = 16
+	// Revoked sessions are announced, and refused by peers, for longer than
+	// any access token lives.
+	SESSION_REVOCATION_WINDOW = time.Hour
+)
+
+var (
+	// Issuer is the "iss" claim of the tokens signed by this node.
+	Issuer string
+
+	activeMutex sync.Mutex
+	active      *db.SigningKey
+)
+
+type AnnouncedKey struct {
+	Key       json.RawMessage `json:"key"`
+	ExpiresAt int64           `json:"expiresAt"`
+}
+
+// Announcement is exchanged between the nodes of a group, so each of them
+// can verify the tokens issued by the others. RevokedSessions lists the
+// sessions of the node revoked within SESSION_REVOCATION_WINDOW, whose
+// tokens peers have to refuse.
+type Announcement struct {
+	Node            string         `json:"node"`
+	Keys            []AnnouncedKey `json:"keys"`
+	RevokedSessions []string       `json:"revokedSessions,omitempty"`
+}
+
+// Init makes sure an active signing key exists and rotates it when due.
+func Init() error {
+	return RotateIfDue()
+}
+
+func activeKey() (*db.SigningKey, error) {
+	activeMutex.Lock()
+	defer activeMutex.Unlock()
+
+	if active != nil {
+		return active, nil
+	}
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		if keys[i].RetiresAt == nil {
+			active = &keys[i]
+			return active, nil
+		}
+	}
+	return nil, fmt.Errorf("no active signing key")
+}
+
+// Rotate creates a new active signing key. The previous key keeps verifying
+// tokens for KEY_RETIREMENT_DELAY.
+func Rotate() error {
+	activeMutex.Lock()
+	defer activeMutex.Unlock()
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	kidBytes := make([]byte, KID_BYTES)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return fmt.Errorf("failed to generate key id: %w", err)
+	}
+	kid := hex.EncodeToString(kidBytes)
+
+	if err := db.AddSigningKey(kid, privateKey, time.Now().Add(KEY_RETIREMENT_DELAY)); err != nil {
+		return err
+	}
+	active = nil
+	return nil
+}
+
+func RotateIfDue() error {
+	key, err := activeKey()
+	if err == nil && time.Since(key.CreatedAt) < KEY_ROTATION_INTERVAL {
+		return nil
+	}
+	return Rotate()
+}
+
+// Sign signs the claims with the active key of this node.
+func Sign(claims jwt.MapClaims) (string, error) {
+	key, err := activeKey()
+	if err != nil {
+		return "", err
+	}
+
+	claims["iss"] = Issuer
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(ed25519.PrivateKey(key.PrivateKey))
+}
+
+// Parse verifies a token signed by this node or by a peer of the group. The
+// returned flag tells whether this node issued the token.
+func Parse(tokenString string) (*jwt.Token, bool, error) {
+	local := false
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("missing key id")
+		}
+
+		publicKey, isLocal, err := lookupKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		local = isLocal
+		return publicKey, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return token, local, nil
+}
+
+func lookupKey(kid string) (ed25519.PublicKey, bool, error) {
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		return nil, false, err
+	}
+	for _, key := range keys {
+		if key.Kid == kid {
+			return ed25519.PrivateKey(key.PrivateKey).Public().(ed25519.PublicKey), true, nil
+		}
+	}
+
+	peerKey, err := db.GetPeerSigningKey(kid)
+	if err != nil {
+		return nil, false, err
+	}
+	publicJWK, err := jwk.ParseKey([]byte(peerKey.Key))
+	if err != nil {
+		return nil, false, err
+	}
+	var publicKey ed25519.PublicKey
+	if err := publicJWK.Raw(&publicKey); err != nil {
+		return nil, false, err
+	}
+	return publicKey, false, nil
+}
+
+func publicJWK(key db.SigningKey) (jwk.Key, error) {
+	publicKey := ed25519.PrivateKey(key.PrivateKey).Public()
+	publicJWK, err := jwk.FromRaw(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := publicJWK.Set(jwk.KeyIDKey, key.Kid); err != nil {
+		return nil, err
+	}
+	if err := publicJWK.Set(jwk.AlgorithmKey, jwa.EdDSA); err != nil {
+		return nil, err
+	}
+	if err := publicJWK.Set(jwk.KeyUsageKey, jwk.ForSignature); err != nil {
+		return nil, err
+	}
+	return publicJWK, nil
+}
+
+// JWKS returns the public keys of this node as a JSON Web Key Set.
+func JWKS() ([]byte, error) {
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	set := jwk.NewSet()
+	for _, key := range keys {
+		publicJWK, err := publicJWK(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := set.AddKey(publicJWK); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(set)
+}
+
+// Announce builds the announcement of the public keys and the recently
+// revoked sessions of this node.
+func Announce() ([]byte, error) {
+	keys, err := db.GetSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := db.GetRevokedSessionIDs(time.Now().Add(-SESSION_REVOCATION_WINDOW))
+	if err != nil {
+		return nil, err
+	}
+
+	announcement := Announcement{Node: Issuer, RevokedSessions: revoked}
+	for _, key := range keys {
+		publicJWK, err := publicJWK(key)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(publicJWK)
+		if err != nil {
+			return nil, err
+		}
+		expiresAt := time.Now().Add(PEER_KEY_TTL)
+		if key.RetiresAt != nil && key.RetiresAt.Before(expiresAt) {
+			expiresAt = *key.RetiresAt
+		}
+		announcement.Keys = append(announcement.Keys, AnnouncedKey{
+			Key:       data,
+			ExpiresAt: expiresAt.Unix(),
+		})
+	}
+	return json.Marshal(announcement)
+}
+
+// ReceiveAnnouncement stores the keys and the session revocations announced
+// by a peer. The sender has to be the node the announcement claims to come
+// from.
+func ReceiveAnnouncement(from string, data []byte) error {
+	var announcement Announcement
+	if err := json.Unmarshal(data, &announcement); err != nil {
+		return err
+	}
+	if announcement.Node != from {
+		return fmt.Errorf("announcement of %s sent by %s", announcement.Node, from)
+	}
+
+	maxExpiry := time.Now().Add(PEER_KEY_TTL)
+	for _, announced := range announcement.Keys {
+		publicJWK, err := jwk.ParseKey(announced.Key)
+		if err != nil {
+			return err
+		}
+		var publicKey ed25519.PublicKey
+		if err := publicJWK.Raw(&publicKey); err != nil {
+			return fmt.Errorf("unsupported key type: %w", err)
+		}
+		if publicJWK.KeyID() == "" {
+			return fmt.Errorf("missing key id")
+		}
+
+		expiresAt := time.Unix(announced.ExpiresAt, 0)
+		if expiresAt.After(maxExpiry) {
+			expiresAt = maxExpiry
+		}
+		err = db.UpsertPeerSigningKey(db.PeerSigningKey{
+			Kid:       publicJWK.KeyID(),
+			Node:      announcement.Node,
+			Key:       string(announced.Key),
+			ExpiresAt: expiresAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	revokedUntil := time.Now().Add(SESSION_REVOCATION_WINDOW)
+	return db.AddPeerSessionRevocations(announcement.Node, announcement.RevokedSessions, revokedUntil)
+}